@@ -7,6 +7,8 @@ require (
 	github.com/bogdanfinn/tls-client v1.11.2
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/image v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
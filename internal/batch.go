@@ -0,0 +1,864 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 批处理状态
+const (
+	BatchValidating = "validating"
+	BatchFailed     = "failed"
+	BatchInProgress = "in_progress"
+	BatchFinalizing = "finalizing"
+	BatchCompleted  = "completed"
+	BatchExpired    = "expired"
+	BatchCancelling = "cancelling"
+	BatchCancelled  = "cancelled"
+)
+
+const (
+	batchCompletionWindow = 24 * time.Hour
+	maxBatchRequests      = 50000
+	maxBatchErrors        = 100
+)
+
+// batchHandlers 批处理支持的接口
+var batchHandlers = map[string]http.HandlerFunc{
+	"/v1/chat/completions": HandleChatCompletions,
+	"/v1/completions":      HandleCompletions,
+}
+
+// Batch OpenAI 批处理对象
+type Batch struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        int64              `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+}
+
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+	Line    *int   `json:"line"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+type BatchRequest struct {
+	InputFileID      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+type BatchListResponse struct {
+	Object  string  `json:"object"`
+	Data    []Batch `json:"data"`
+	FirstID *string `json:"first_id"`
+	LastID  *string `json:"last_id"`
+	HasMore bool    `json:"has_more"`
+}
+
+// batchInputLine 输入文件中的一行
+type batchInputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResultLine 输出文件和错误文件中的一行
+type batchResultLine struct {
+	ID       string             `json:"id"`
+	CustomID string             `json:"custom_id"`
+	Response *batchResponse     `json:"response"`
+	Error    *batchRequestError `json:"error"`
+}
+
+type batchResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type batchRequestError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// batchProgress 执行进度，逐行追加到 data_dir/batches/<id>.progress.jsonl，重启后跳过已完成的请求
+type batchProgress struct {
+	Line    int             `json:"line"`
+	Success bool            `json:"success"`
+	Result  batchResultLine `json:"result"`
+}
+
+// storedBatch 本地记录的批处理；Token 为创建者令牌，批处理结束后清除
+type storedBatch struct {
+	Batch
+	Owner string `json:"owner"`
+	Token string `json:"token,omitempty"`
+}
+
+// batchStore 批处理存储，持久化到 data_dir/batches.json
+type batchStore struct {
+	mu      sync.Mutex
+	path    string
+	dir     string
+	batches map[string]*storedBatch
+	cancels map[string]context.CancelFunc
+	slots   chan struct{} // 所有批处理共享的并发上限
+}
+
+var batches *batchStore
+
+// InitBatchStore 从数据目录加载批处理记录，需在 InitFileStore 之后调用
+func InitBatchStore() error {
+	dir := GetConfig().DataDir
+	store := &batchStore{
+		path:    filepath.Join(dir, "batches.json"),
+		dir:     filepath.Join(dir, "batches"),
+		batches: make(map[string]*storedBatch),
+		cancels: make(map[string]context.CancelFunc),
+		slots:   make(chan struct{}, GetConfig().BatchConcurrency),
+	}
+	if err := os.MkdirAll(store.dir, 0o700); err != nil {
+		return fmt.Errorf("create batch dir %s: %w", store.dir, err)
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read batch store: %w", err)
+	}
+	if len(data) > 0 {
+		var list []*storedBatch
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("parse batch store %s: %w", store.path, err)
+		}
+		for _, b := range list {
+			store.batches[b.ID] = b
+		}
+	}
+
+	batches = store
+	LogInfo("Loaded %d batches from %s", len(store.batches), store.path)
+	return nil
+}
+
+// ResumeBatches 继续执行重启前未完成的批处理
+func ResumeBatches() {
+	batches.mu.Lock()
+	defer batches.mu.Unlock()
+	for _, b := range batches.batches {
+		switch b.Status {
+		case BatchValidating, BatchInProgress, BatchFinalizing, BatchCancelling:
+			LogInfo("Resuming batch %s (%s)", b.ID, b.Status)
+			batches.start(b)
+		}
+	}
+}
+
+// usesInput 判断是否有未结束的批处理以 fileID 为输入，重启续跑时需要重新读取输入文件。调用方需持有锁
+func (s *batchStore) usesInput(fileID string) bool {
+	for _, b := range s.batches {
+		switch b.Status {
+		case BatchValidating, BatchInProgress, BatchFinalizing, BatchCancelling:
+			if b.InputFileID == fileID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeFile 删除文件，仍是未结束批处理的输入时返回 errFileInUse。
+// 检查与删除都在 s.mu 内完成，create 也在同一把锁内确认输入文件仍存在，二者不会交错
+func (s *batchStore) removeFile(id, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.usesInput(id) {
+		if _, ok := files.get(id, owner); ok {
+			return false, errFileInUse
+		}
+	}
+	return files.remove(id, owner)
+}
+
+var errFileInUse = errors.New("file is the input of a batch that has not finished")
+
+// save 持久化批处理记录，调用方需持有锁
+func (s *batchStore) save() {
+	list := make([]*storedBatch, 0, len(s.batches))
+	for _, b := range s.batches {
+		list = append(list, b)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		LogError("Failed to save batch store: %v", err)
+	}
+}
+
+func (s *batchStore) progressPath(id string) string {
+	return filepath.Join(s.dir, id+".progress.jsonl")
+}
+
+// get 返回批处理对象的副本
+func (s *batchStore) get(id, owner string) (Batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	if !ok || b.Owner != owner {
+		return Batch{}, false
+	}
+	return b.Batch, true
+}
+
+// list 按创建时间倒序返回 after 之后的最多 limit 个批处理
+func (s *batchStore) list(owner, after string, limit int) BatchListResponse {
+	s.mu.Lock()
+	var all []Batch
+	for _, b := range s.batches {
+		if b.Owner == owner {
+			all = append(all, b.Batch)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].CreatedAt != all[j].CreatedAt {
+			return all[i].CreatedAt > all[j].CreatedAt
+		}
+		return all[i].ID > all[j].ID
+	})
+	if after != "" {
+		for i, b := range all {
+			if b.ID == after {
+				all = all[i+1:]
+				break
+			}
+		}
+	}
+
+	resp := BatchListResponse{Object: "list", Data: []Batch{}}
+	if len(all) > limit {
+		all, resp.HasMore = all[:limit], true
+	}
+	if len(all) > 0 {
+		resp.Data = all
+		resp.FirstID = stringPtr(all[0].ID)
+		resp.LastID = stringPtr(all[len(all)-1].ID)
+	}
+	return resp
+}
+
+func (s *batchStore) create(req BatchRequest, token string) (Batch, error) {
+	now := time.Now()
+	b := &storedBatch{
+		Batch: Batch{
+			ID:               "batch_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileID:      req.InputFileID,
+			CompletionWindow: req.CompletionWindow,
+			Status:           BatchValidating,
+			CreatedAt:        now.Unix(),
+			ExpiresAt:        now.Add(batchCompletionWindow).Unix(),
+			Metadata:         req.Metadata,
+		},
+		Owner: ownerID(token),
+		Token: token,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 在锁内确认输入文件，避免与删除文件交错
+	if f, ok := files.get(req.InputFileID, b.Owner); !ok || f.Purpose != "batch" {
+		return Batch{}, errBatchInputNotFound
+	}
+	s.batches[b.ID] = b
+	s.save()
+	s.start(b)
+	return b.Batch, nil
+}
+
+var errBatchInputNotFound = errors.New("input file not found")
+
+// cancel 请求取消，已完成的请求仍会写入结果文件
+func (s *batchStore) cancel(id, owner string) (Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[id]
+	if !ok || b.Owner != owner {
+		return Batch{}, errBatchNotFound
+	}
+	switch b.Status {
+	case BatchValidating, BatchInProgress:
+	case BatchCancelling:
+		return b.Batch, nil
+	default:
+		return Batch{}, fmt.Errorf("cannot cancel a batch with status %s", b.Status)
+	}
+
+	b.Status = BatchCancelling
+	b.CancellingAt = unixNow()
+	s.save()
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+	}
+	return b.Batch, nil
+}
+
+var errBatchNotFound = errors.New("batch not found")
+
+// start 启动执行协程，调用方需持有锁
+func (s *batchStore) start(b *storedBatch) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Unix(b.ExpiresAt, 0))
+	if b.Status == BatchCancelling {
+		cancel()
+	}
+	s.cancels[b.ID] = cancel
+	go s.run(ctx, b)
+}
+
+// update 在锁内修改批处理并持久化
+func (s *batchStore) update(b *storedBatch, fn func(b *storedBatch)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(b)
+	s.save()
+}
+
+func (s *batchStore) run(ctx context.Context, b *storedBatch) {
+	defer func() {
+		s.mu.Lock()
+		if cancel, ok := s.cancels[b.ID]; ok {
+			cancel()
+			delete(s.cancels, b.ID)
+		}
+		s.mu.Unlock()
+	}()
+
+	lines, errs := s.loadInput(b)
+	if len(errs) > 0 {
+		s.update(b, func(b *storedBatch) {
+			b.Status = BatchFailed
+			b.FailedAt = unixNow()
+			b.Errors = &BatchErrors{Object: "list", Data: errs}
+			b.Token = ""
+		})
+		LogWarn("Batch %s failed validation: %s", b.ID, errs[0].Message)
+		return
+	}
+
+	progress, err := s.loadProgress(b.ID)
+	if err != nil {
+		LogError("Failed to read progress of batch %s: %v", b.ID, err)
+	}
+	var status string
+	s.update(b, func(b *storedBatch) {
+		b.RequestCounts = BatchRequestCounts{Total: len(lines)}
+		for _, p := range progress {
+			if p.Success {
+				b.RequestCounts.Completed++
+			} else {
+				b.RequestCounts.Failed++
+			}
+		}
+		if b.Status == BatchValidating {
+			b.Status = BatchInProgress
+			b.InProgressAt = unixNow()
+		}
+		status = b.Status
+	})
+
+	if status == BatchInProgress {
+		s.execute(ctx, b, lines, progress)
+	}
+	s.finalize(ctx, b)
+}
+
+// loadInput 读取并校验输入文件，返回逐行错误
+func (s *batchStore) loadInput(b *storedBatch) ([]batchInputLine, []BatchError) {
+	fail := func(code, message string) []BatchError {
+		return []BatchError{{Code: code, Message: message, Param: "input_file_id"}}
+	}
+
+	f, ok := files.get(b.InputFileID, b.Owner)
+	if !ok {
+		return nil, fail("invalid_file", fmt.Sprintf("No such file: %s", b.InputFileID))
+	}
+	if f.Purpose != "batch" {
+		return nil, fail("invalid_file", fmt.Sprintf("File %s has purpose %s, expected batch", f.ID, f.Purpose))
+	}
+	data, err := files.content(f)
+	if err != nil {
+		return nil, fail("invalid_file", err.Error())
+	}
+
+	var lines []batchInputLine
+	var errs []BatchError
+	seen := make(map[string]bool)
+	lineErr := func(n int, code, message string) {
+		if len(errs) < maxBatchErrors {
+			errs = append(errs, BatchError{Code: code, Message: message, Line: &n})
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var line batchInputLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			lineErr(n, "invalid_json_line", fmt.Sprintf("Invalid JSON: %v", err))
+			continue
+		}
+		switch {
+		case line.CustomID == "":
+			lineErr(n, "missing_required_parameter", "custom_id: required")
+		case seen[line.CustomID]:
+			lineErr(n, "duplicate_custom_id", fmt.Sprintf("custom_id %q is used more than once", line.CustomID))
+		case line.Method != http.MethodPost:
+			lineErr(n, "invalid_method", fmt.Sprintf("method: must be POST, got %q", line.Method))
+		case line.URL != b.Endpoint:
+			lineErr(n, "mismatched_url", fmt.Sprintf("url: must match the batch endpoint %s, got %q", b.Endpoint, line.URL))
+		case !isJSONObject(line.Body):
+			lineErr(n, "invalid_body", "body: must be a JSON object")
+		}
+		seen[line.CustomID] = true
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fail("invalid_file", fmt.Sprintf("Failed to read input file: %v", err))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if len(lines) == 0 {
+		return nil, fail("empty_file", "The input file contains no requests")
+	}
+	if len(lines) > maxBatchRequests {
+		return nil, fail("too_many_requests", fmt.Sprintf("The input file contains %d requests, the limit is %d", len(lines), maxBatchRequests))
+	}
+	return lines, nil
+}
+
+func isJSONObject(raw json.RawMessage) bool {
+	var obj map[string]json.RawMessage
+	return json.Unmarshal(raw, &obj) == nil && obj != nil
+}
+
+// loadProgress 读取已完成请求的结果，忽略崩溃时写了一半的最后一行
+func (s *batchStore) loadProgress(id string) (map[int]batchProgress, error) {
+	progress := make(map[int]batchProgress)
+	data, err := os.ReadFile(s.progressPath(id))
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return progress, err
+	}
+	for _, raw := range bytes.Split(data, []byte("\n")) {
+		var p batchProgress
+		if len(bytes.TrimSpace(raw)) == 0 || json.Unmarshal(raw, &p) != nil {
+			continue
+		}
+		progress[p.Line] = p
+	}
+	return progress, nil
+}
+
+// execute 并发执行尚未完成的请求，每完成一个就追加到进度文件
+func (s *batchStore) execute(ctx context.Context, b *storedBatch, lines []batchInputLine, progress map[int]batchProgress) {
+	out, err := os.OpenFile(s.progressPath(b.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		LogError("Failed to open progress of batch %s: %v", b.ID, err)
+		return
+	}
+	defer out.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, line := range lines {
+		if _, done := progress[i]; done {
+			continue
+		}
+		// 批处理直接调用处理函数，不经过 WithRateLimit，需按创建者的调用方限额排队
+		if waitClientRate(ctx, b.Token) != nil || ctx.Err() != nil {
+			break
+		}
+		acquired := false
+		select {
+		case s.slots <- struct{}{}:
+			acquired = true
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			// 两个分支同时就绪时可能已取得名额，需要归还
+			if acquired {
+				<-s.slots
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-s.slots }()
+
+			result, ok := executeBatchLine(ctx, b, line)
+			if !ok {
+				return
+			}
+			p := batchProgress{Line: i, Success: result.Response != nil && result.Response.StatusCode < 300, Result: result}
+			data, _ := json.Marshal(p)
+
+			mu.Lock()
+			if _, err := out.Write(append(data, '\n')); err != nil {
+				LogError("Failed to write progress of batch %s: %v", b.ID, err)
+			}
+			mu.Unlock()
+
+			s.mu.Lock()
+			if p.Success {
+				b.RequestCounts.Completed++
+			} else {
+				b.RequestCounts.Failed++
+			}
+			s.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// executeBatchLine 通过对应接口的处理函数执行一行请求，限流和上游错误时重试；
+// 批处理被取消或过期时返回 false，不记录结果
+func executeBatchLine(ctx context.Context, b *storedBatch, line batchInputLine) (batchResultLine, bool) {
+	result := batchResultLine{
+		ID:       "batch_req_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		CustomID: line.CustomID,
+	}
+	body := nonStreamBody(line.Body)
+
+	var rec *batchRecorder
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, line.URL, bytes.NewReader(body))
+		if err != nil {
+			result.Error = &batchRequestError{Code: "invalid_request", Message: err.Error()}
+			return result, true
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+batchToken(b))
+
+		rec = newBatchRecorder()
+		batchHandlers[line.URL](rec, req)
+		if ctx.Err() != nil {
+			return result, false
+		}
+		if !retryableStatus(rec.status) || attempt >= GetConfig().BatchMaxRetries {
+			break
+		}
+
+		delay := time.Duration(1<<attempt) * time.Second
+		LogWarn("Batch %s request %s got status %d, retrying in %s", b.ID, line.CustomID, rec.status, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, false
+		}
+	}
+
+	respBody := bytes.TrimSpace(rec.body.Bytes())
+	if !json.Valid(respBody) {
+		respBody, _ = json.Marshal(ErrorResponse{Error: ErrorDetail{Message: string(respBody), Type: "upstream_error"}})
+	}
+	result.Response = &batchResponse{
+		StatusCode: rec.status,
+		RequestID:  "req_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Body:       respBody,
+	}
+	return result, true
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// batchToken 开启 batch_use_pool 时轮流使用令牌池，否则使用创建者的令牌
+func batchToken(b *storedBatch) string {
+	if GetConfig().BatchUsePool {
+		if token := NextPoolToken(); token != "" {
+			return token
+		}
+	}
+	return b.Token
+}
+
+// nonStreamBody 批处理只收集完整响应，去掉 stream 参数
+func nonStreamBody(raw json.RawMessage) []byte {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return raw
+	}
+	delete(obj, "stream")
+	delete(obj, "stream_options")
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return raw
+	}
+	return data
+}
+
+// batchRecorder 收集处理函数写出的响应
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBatchRecorder() *batchRecorder {
+	return &batchRecorder{header: make(http.Header)}
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *batchRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// finalize 按输入顺序生成输出文件和错误文件，并设置最终状态
+func (s *batchStore) finalize(ctx context.Context, b *storedBatch) {
+	final := BatchCompleted
+	s.mu.Lock()
+	switch {
+	case b.Status == BatchCancelling:
+		final = BatchCancelled
+	case b.Status == BatchFailed:
+		s.mu.Unlock()
+		return
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		final = BatchExpired
+	}
+	b.Status = BatchFinalizing
+	b.FinalizingAt = unixNow()
+	s.save()
+	s.mu.Unlock()
+
+	progress, err := s.loadProgress(b.ID)
+	if err != nil {
+		LogError("Failed to read progress of batch %s: %v", b.ID, err)
+	}
+	indexes := make([]int, 0, len(progress))
+	for i := range progress {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	var output, errorOutput bytes.Buffer
+	for _, i := range indexes {
+		data, _ := json.Marshal(progress[i].Result)
+		if progress[i].Success {
+			output.Write(append(data, '\n'))
+		} else {
+			errorOutput.Write(append(data, '\n'))
+		}
+	}
+
+	outputID := s.writeResultFile(b, "output", output.Bytes())
+	errorID := s.writeResultFile(b, "errors", errorOutput.Bytes())
+
+	var counts BatchRequestCounts
+	s.update(b, func(b *storedBatch) {
+		b.OutputFileID = outputID
+		b.ErrorFileID = errorID
+		b.Status = final
+		switch final {
+		case BatchCompleted:
+			b.CompletedAt = unixNow()
+		case BatchCancelled:
+			b.CancelledAt = unixNow()
+		case BatchExpired:
+			b.ExpiredAt = unixNow()
+		}
+		b.Token = ""
+		counts = b.RequestCounts
+	})
+	os.Remove(s.progressPath(b.ID))
+	LogInfo("Batch %s %s: %d completed, %d failed of %d", b.ID, final, counts.Completed, counts.Failed, counts.Total)
+}
+
+// writeResultFile 保存结果文件，内容为空时不生成
+func (s *batchStore) writeResultFile(b *storedBatch, kind string, data []byte) *string {
+	if len(data) == 0 {
+		return nil
+	}
+	f, err := files.addLocal(b.Owner, fmt.Sprintf("%s_%s.jsonl", b.ID, kind), "batch_output", data)
+	if err != nil {
+		LogError("Failed to save %s file of batch %s: %v", kind, b.ID, err)
+		return nil
+	}
+	return stringPtr(f.ID)
+}
+
+func unixNow() *int64 {
+	now := time.Now().Unix()
+	return &now
+}
+
+func writeBatchJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// HandleBatches 创建（POST）和列出（GET）批处理
+func HandleBatches(w http.ResponseWriter, r *http.Request) {
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		limit := 20
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 100 {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", "", "limit: must be between 1 and 100")
+				return
+			}
+			limit = n
+		}
+		writeBatchJSON(w, batches.list(ownerID(token), r.URL.Query().Get("after"), limit))
+	case http.MethodPost:
+		var req BatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if _, ok := batchHandlers[req.Endpoint]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "",
+				fmt.Sprintf("endpoint: must be /v1/chat/completions or /v1/completions, got %q", req.Endpoint))
+			return
+		}
+		if req.CompletionWindow != "24h" {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "",
+				fmt.Sprintf("completion_window: must be 24h, got %q", req.CompletionWindow))
+			return
+		}
+		b, err := batches.create(req, token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "",
+				fmt.Sprintf("input_file_id: no file with purpose batch found for %q", req.InputFileID))
+			return
+		}
+		writeBatchJSON(w, b)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleBatch 查询单个批处理
+func HandleBatch(w http.ResponseWriter, r *http.Request) {
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	b, ok := batches.get(id, ownerID(token))
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "batch_not_found", fmt.Sprintf("No such batch: %s", id))
+		return
+	}
+	writeBatchJSON(w, b)
+}
+
+// HandleBatchCancel 取消批处理
+func HandleBatchCancel(w http.ResponseWriter, r *http.Request) {
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	b, err := batches.cancel(id, ownerID(token))
+	if errors.Is(err, errBatchNotFound) {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "batch_not_found", fmt.Sprintf("No such batch: %s", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, "invalid_request_error", "", err.Error())
+		return
+	}
+	writeBatchJSON(w, b)
+}
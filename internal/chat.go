@@ -1,17 +1,21 @@
 package internal
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	fhttp "github.com/bogdanfinn/fhttp"
+	"github.com/google/uuid"
 )
 
 var (
@@ -25,40 +29,21 @@ func escapeMarkdownText(text string) string {
 	return text
 }
 
-func HandleModels(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var models []ModelInfo
-	for id := range ModelMapping {
-		models = append(models, ModelInfo{
-			ID:      id,
-			Object:  "model",
-			Created: 1700000000,
-			OwnedBy: "grok",
-		})
-	}
-
-	resp := ModelsResponse{
-		Object: "list",
-		Data:   models,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
-}
-
 func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
+	// 断线重连：从缓冲区续传，忽略请求体，EventSource 重连时为 GET；未开启续传时忽略该请求头
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" && GetConfig().StreamResumeTTL > 0 {
+		handleStreamResume(w, r, lastEventID)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -70,60 +55,330 @@ func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	cookie := fmt.Sprintf("sso-rw=%s;sso=%s", token, token)
+	cacheKey, served := serveFromCache(w, r, &req)
+	if served {
+		return
+	}
+
+	// 缓冲区按令牌区分所有者，未携带令牌的调用方无法互相隔离，不缓冲
+	if req.Stream && GetConfig().StreamResumeTTL > 0 && BearerToken(r) != "" {
+		handleResumableStream(w, r, &req, cacheKey)
+		return
+	}
+
+	run, err := startChat(r.Context(), &req, BearerToken(r))
+	if err != nil {
+		writeChatError(w, err)
+		return
+	}
+	defer run.Close()
+	run.Opts.CacheKey = cacheKey
+
+	if req.Stream {
+		handleStreamResponse(w, run.Choices, run.Opts)
+		return
+	}
+	handleNonStreamResponse(w, run.Choices, run.Opts, run.Send)
+}
+
+// requestError 发往上游之前发现的请求参数错误
+type requestError struct {
+	Status  int
+	Code    string
+	Message string
+}
 
-	modelConfig, exists := ModelMapping[req.Model]
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+func badRequest(err error) *requestError {
+	return &requestError{Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+// chatRun 已发起上游对话的一次请求，各 API 前端只负责转换输出格式
+type chatRun struct {
+	Opts    responseOptions
+	Choices []*upstreamChoice
+	Send    func(cookie string, extra []Message) (*fhttp.Response, error) // 在相同上下文中追加消息重新发起对话
+}
+
+// Close 关闭所有上游响应
+func (c *chatRun) Close() {
+	for _, choice := range c.Choices {
+		if choice.Resp != nil {
+			choice.Resp.Body.Close()
+		}
+	}
+}
+
+// startChat 解析请求参数、上传附件并发起上游对话；ctx 结束时取消上游请求，通常为客户端请求的上下文
+func startChat(ctx context.Context, req *ChatRequest, token string) (*chatRun, error) {
+	if err := applyReasoningEffort(req); err != nil {
+		return nil, badRequest(err)
+	}
+
+	_, modelConfig, exists := LookupModel(req.Model)
 	if !exists {
+		if GetConfig().StrictModels {
+			return nil, &requestError{Status: http.StatusNotFound, Code: "model_not_found",
+				Message: fmt.Sprintf("The model `%s` does not exist", req.Model)}
+		}
 		modelConfig = ModelConfig{
 			ModelName: req.Model,
 			ModelMode: "MODEL_MODE_AUTO",
 		}
 	}
 
-	fileAttachments, err := ExtractAndUploadImages(req.Messages, cookie)
+	features, err := ResolveFeatures(req, modelConfig)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	ctx = withSharedSlot(ctx)
+	token, err = selectPoolToken(token, modelConfig.ModelMode)
+	if err != nil {
+		return nil, err
+	}
+	cookie := BuildCookie(token)
+
+	opts := responseOptions{
+		ID:           "chatcmpl-" + strings.ReplaceAll(uuid.New().String(), "-", ""), // 同时作为续传缓冲区的键，不可预测
+		Model:        req.Model,
+		ModelMode:    modelConfig.ModelMode,
+		Cookie:       cookie,
+		CitationMode: GetConfig().CitationMode,
+	}
+	if req.Grok != nil && req.Grok.Citations != "" {
+		opts.CitationMode = req.Grok.Citations
+	}
+	if !validCitationMode(opts.CitationMode) {
+		return nil, badRequest(fmt.Errorf("grok.citations: must be one of markdown, annotations, inline, got %q", opts.CitationMode))
+	}
+	if opts.ReasoningFormat, err = resolveReasoningFormat(req, token); err != nil {
+		return nil, badRequest(err)
+	}
+
+	if opts.Stops, err = parseStop(req.Stop); err != nil {
+		return nil, badRequest(err)
+	}
+	if opts.MaxTokens, err = resolveMaxTokens(req); err != nil {
+		return nil, badRequest(err)
+	}
+
+	n, err := resolveChoiceCount(req)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	opts.IncludeUsage = req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+
+	if opts.Structured, err = parseResponseFormat(req.ResponseFormat); err != nil {
+		return nil, badRequest(err)
+	}
+	if opts.Structured != nil && opts.ReasoningFormat == ReasoningThinkTags {
+		// JSON 输出时思考内容不能混入正文
+		opts.ReasoningFormat = ReasoningContentField
+	}
+
+	attachHistory := GetConfig().AttachHistory
+	fileIDs, err := UploadAttachments(collectAttachments(req.Messages, attachHistory), token)
 	if err != nil {
-		LogError("Failed to upload images: %v", err)
+		return nil, badRequest(err)
+	}
+	messages, fileAttachments := flattenMessages(req.Messages, attachHistory, fileIDs)
+
+	build := func(messages []Message) GrokRequest {
+		grokReq := prepareGrokRequest(messages, modelConfig, fileAttachments, features)
+		if opts.Structured != nil {
+			if grokReq.CustomPersonality != "" {
+				grokReq.CustomPersonality += "\n\n"
+			}
+			grokReq.CustomPersonality += opts.Structured.instructions()
+		}
+		return grokReq
+	}
+	grokReq := build(messages)
+	opts.PromptTokens = EstimateTokens(grokReq.CustomPersonality) + EstimateTokens(grokReq.Message)
+
+	send := func(cookie string, extra []Message) (*fhttp.Response, error) {
+		msgs := messages
+		if len(extra) > 0 {
+			msgs = append(messages[:len(messages):len(messages)], extra...)
+		}
+		return sendGrokRequest(ctx, build(msgs), cookie)
 	}
 
-	grokReq := prepareGrokRequest(req.Messages, modelConfig, fileAttachments)
+	// 上传的附件属于调用方账号，带附件时不能换用令牌池
+	usePool := GetConfig().ChoicesUsePool && len(fileAttachments) == 0
+	run := &chatRun{Opts: opts, Send: send}
+	run.Choices = startChoices(n, cookie, modelConfig.ModelMode, usePool, func(cookie string) (*fhttp.Response, error) {
+		return send(cookie, nil)
+	})
+
+	errs := make([]error, len(run.Choices))
+	for i, c := range run.Choices {
+		errs[i] = c.Err
+	}
+	if err := firstChoiceError(errs); err != nil {
+		run.Close()
+		return nil, err
+	}
+	return run, nil
+}
 
+// upstreamStatusError 上游返回非 200 状态
+type upstreamStatusError struct {
+	StatusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("Upstream error: %d", e.StatusCode)
+}
+
+// sendGrokRequest 发起新对话请求，成功时调用方负责关闭响应体
+func sendGrokRequest(ctx context.Context, grokReq GrokRequest, cookie string) (*fhttp.Response, error) {
 	body, _ := json.Marshal(grokReq)
 	LogDebug("Grok request: %s", string(body))
 
-	upstreamReq, err := fhttp.NewRequest("POST", BaseURL+"/rest/app-chat/conversations/new", bytes.NewReader(body))
+	upstreamReq, err := fhttp.NewRequestWithContext(ctx, "POST", BaseURL+"/rest/app-chat/conversations/new", bytes.NewReader(body))
 	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	SetChatHeaders(upstreamReq, cookie)
 
+	release, err := acquireUpstream(ctx, grokReq.ModelName, cookie)
+	if err != nil {
+		return nil, err
+	}
+
 	client := GetHTTPClient()
 	resp, err := client.Do(upstreamReq)
 	if err != nil {
+		release()
 		LogError("Failed to connect to upstream: %v", err)
-		http.Error(w, "Failed to connect to upstream", http.StatusBadGateway)
-		return
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		bodyText := string(bodyBytes)
-		LogError("Upstream error - Status: %d, Response: %s", resp.StatusCode, bodyText)
-		http.Error(w, fmt.Sprintf("Upstream error: %d", resp.StatusCode), resp.StatusCode)
+		resp.Body.Close()
+		release()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			quotas.recordLimited(cookie, grokReq.ModelMode)
+		}
+		LogError("Upstream error - Status: %d, Response: %s", resp.StatusCode, string(bodyBytes))
+		return nil, &upstreamStatusError{StatusCode: resp.StatusCode}
+	}
+	quotas.recordUse(cookie, grokReq.ModelMode, grokReq.ModelName)
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// writeChatError 按 OpenAI 格式返回 startChat 的错误
+func writeChatError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		writeError(w, reqErr.Status, "invalid_request_error", reqErr.Code, reqErr.Message)
 		return
 	}
+	writeChoiceError(w, err)
+}
 
-	if req.Stream {
-		handleStreamResponse(w, resp, req.Model, cookie)
-	} else {
-		handleNonStreamResponse(w, resp, req.Model, cookie)
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		http.Error(w, statusErr.Error(), statusErr.StatusCode)
+		return
+	}
+	http.Error(w, "Failed to connect to upstream", http.StatusBadGateway)
+}
+
+func lastUserIndex(messages []Message) int {
+	lastUser := -1
+	for i, msg := range messages {
+		if msg.Role == "user" {
+			lastUser = i
+		}
+	}
+	return lastUser
+}
+
+// collectAttachments 按出现顺序返回需要上传的附件，默认只附加最后一条 user 消息中的附件
+func collectAttachments(messages []Message, attachHistory bool) []Attachment {
+	lastUser := lastUserIndex(messages)
+	var attachments []Attachment
+	for i, msg := range messages {
+		if !attachHistory && i != lastUser {
+			continue
+		}
+		for _, part := range msg.Parts() {
+			if part.Attachment != nil {
+				attachments = append(attachments, *part.Attachment)
+			}
+		}
+	}
+	return attachments
+}
+
+// flattenMessages 展平消息内容，附件位置替换为 [image N] / [file N: name] 占位符。
+// fileIDs 与 collectAttachments 的结果一一对应，N 为文件在返回列表中的序号：
+// 相同文件只附加一次并沿用同一序号，上传失败被丢弃的附件显示为 [image not attached]
+func flattenMessages(messages []Message, attachHistory bool, fileIDs []string) ([]Message, []string) {
+	lastUser := lastUserIndex(messages)
+
+	var files []string
+	numbers := make(map[string]int)
+	next := 0
+	flattened := make([]Message, len(messages))
+	for i, msg := range messages {
+		var b strings.Builder
+		afterPlaceholder := false
+		for _, part := range msg.Parts() {
+			if part.Attachment == nil {
+				if afterPlaceholder && part.Text != "" && !strings.HasPrefix(part.Text, "\n") {
+					b.WriteString("\n")
+				}
+				b.WriteString(part.Text)
+				afterPlaceholder = false
+				continue
+			}
+
+			att := *part.Attachment
+			var id string
+			if attachHistory || i == lastUser {
+				if next < len(fileIDs) {
+					id = fileIDs[next]
+				}
+				next++
+			}
+			placeholder := fmt.Sprintf("[%s not attached]", att.Type)
+			if id != "" {
+				n, ok := numbers[id]
+				if !ok {
+					files = append(files, id)
+					n = len(files)
+					numbers[id] = n
+				}
+				placeholder = fmt.Sprintf("[%s %d]", att.Type, n)
+				if att.Filename != "" {
+					placeholder = fmt.Sprintf("[%s %d: %s]", att.Type, n, att.Filename)
+				}
+			}
+
+			if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+				b.WriteString("\n")
+			}
+			b.WriteString(placeholder)
+			afterPlaceholder = true
+		}
+		flattened[i] = Message{Role: msg.Role, Content: b.String()}
 	}
+
+	return flattened, files
 }
 
-func prepareGrokRequest(messages []Message, modelConfig ModelConfig, fileAttachments []string) GrokRequest {
+func prepareGrokRequest(messages []Message, modelConfig ModelConfig, fileAttachments []string, features GrokFeatures) GrokRequest {
 	var processed []string
 	var lastRole string
 	var customPersonality string
@@ -171,17 +426,17 @@ func prepareGrokRequest(messages []Message, modelConfig ModelConfig, fileAttachm
 		Message:                   strings.Join(processed, "\n"),
 		FileAttachments:           []string{},
 		ImageAttachments:          []interface{}{},
-		DisableSearch:             false,
-		EnableImageGeneration:     true,
+		DisableSearch:             features.DisableSearch,
+		EnableImageGeneration:     features.EnableImageGeneration,
 		ReturnImageBytes:          false,
 		ReturnRawGrokInXaiRequest: false,
 		EnableImageStreaming:      true,
-		ImageGenerationCount:      2,
-		ForceConcise:              false,
-		ToolOverrides:             map[string]interface{}{},
+		ImageGenerationCount:      features.ImageGenerationCount,
+		ForceConcise:              features.ForceConcise,
+		ToolOverrides:             features.ToolOverrides,
 		EnableSideBySide:          false,
 		SendFinalMetadata:         true,
-		IsReasoning:               false,
+		IsReasoning:               features.IsReasoning,
 		DisableTextFollowUps:      false,
 		ResponseMetadata: ResponseMetadata{
 			ModelConfigOverride: ModelConfigOverride{
@@ -207,6 +462,10 @@ func prepareGrokRequest(messages []Message, modelConfig ModelConfig, fileAttachm
 		grokReq.FileAttachments = fileAttachments
 	}
 
+	if features.DeepSearch {
+		grokReq.DeepsearchPreset = "default"
+	}
+
 	return grokReq
 }
 
@@ -299,11 +558,44 @@ func writeSSE(w http.ResponseWriter, data interface{}) {
 	fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
 }
 
+// writeError 返回 OpenAI 格式的错误响应
+func writeError(w http.ResponseWriter, status int, errType, code, message string) {
+	detail := ErrorDetail{Message: message, Type: errType}
+	if code != "" {
+		detail.Code = stringPtr(code)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: detail})
+}
+
 func stringPtr(s string) *string {
 	return &s
 }
 
-func handleStreamResponse(w http.ResponseWriter, resp *fhttp.Response, model, cookie string) {
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// responseOptions 转换上游响应所需的参数
+type responseOptions struct {
+	ID              string // 同一次请求的所有 chunk 共用
+	Model           string
+	ModelMode       string // 上游模型模式，用于统计令牌额度
+	Cookie          string
+	CitationMode    string
+	ReasoningFormat string
+	Stops           []string
+	MaxTokens       int
+	PromptTokens    int
+	Structured      *structuredOutput
+	IncludeUsage    bool
+	Progress        func(StreamEvent) // 非流式汇总时逐段回调，用于异步任务查询部分输出
+	CacheKey        string            // 非空时成功的响应写入缓存
+}
+
+func handleStreamResponse(w http.ResponseWriter, choices []*upstreamChoice, opts responseOptions) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -315,234 +607,328 @@ func handleStreamResponse(w http.ResponseWriter, resp *fhttp.Response, model, co
 		return
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	var imageURLs []string
-	var conversationID, responseID string
-
-	writeSSE(w, createChunk(model, "", "", false, true))
-	flusher.Flush()
+	streamEvents(choices, opts, func(data []byte) {
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	})
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
+// streamEvents 合并各路候选的输出，依次把每个 SSE 事件的 data 交给 emit，正常结束时最后为 [DONE]
+func streamEvents(choices []*upstreamChoice, opts responseOptions, emit func(data []byte)) {
+	var collector *streamCollector
+	if opts.CacheKey != "" {
+		collector = newStreamCollector(opts)
+		output := emit
+		emit = func(data []byte) {
+			collector.add(data)
+			output(data)
 		}
+	}
+	send := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		emit(data)
+	}
 
-		var streamResp GrokStreamResponse
-		if err := json.Unmarshal([]byte(line), &streamResp); err != nil {
-			LogError("Failed to parse upstream response: %v, line: %s", err, line)
-			continue
-		}
+	for _, c := range choices {
+		chunk := createChunk(opts.Model, "", "", false, true)
+		chunk.ID = opts.ID
+		chunk.Choices[0].Index = c.Index
+		send(chunk)
+	}
 
-		LogDebug("Upstream response: %s", line)
+	// 各路对话在独立 goroutine 中读取，统一由当前 goroutine 写出
+	events := make(chan interface{})
+	usages := make([]Usage, len(choices))
+	failed := make([]bool, len(choices))
+	truncated := make([]bool, len(choices))
+	var wg sync.WaitGroup
+	for i, c := range choices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			usages[i], failed[i], truncated[i] = streamChoice(c, opts, len(choices) > 1, events)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
 
-		if streamResp.Error != nil {
-			writeSSE(w, map[string]interface{}{
-				"error": map[string]string{
-					"message": "RateLimitError",
-					"type":    "rate_limit_error",
-				},
-			})
-			flusher.Flush()
-			return
-		}
+	for ev := range events {
+		send(ev)
+	}
 
-		data := streamResp.Result
-		if data == nil {
-			continue
-		}
+	if len(choices) == 1 && failed[0] {
+		return
+	}
 
-		if data.Conversation != nil && data.Conversation.ConversationID != "" {
-			conversationID = data.Conversation.ConversationID
-		}
+	total := sumUsage(usages)
+	if opts.IncludeUsage {
+		send(ChatCompletionChunk{
+			ID:      opts.ID,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   opts.Model,
+			Choices: []Choice{},
+			Usage:   &total,
+		})
+	}
 
-		if data.Response == nil {
-			continue
-		}
+	emit([]byte("[DONE]"))
+	// 读取中断的输出不完整，不写入缓存
+	if collector != nil && !slices.Contains(truncated, true) {
+		collector.store(total)
+	}
+}
 
-		grokResp := data.Response
+// streamChoice 转换一路上游对话的输出，返回用量、是否因上游错误失败以及读取是否中断
+func streamChoice(c *upstreamChoice, opts responseOptions, multi bool, out chan<- interface{}) (Usage, bool, bool) {
+	opts.Cookie = c.Cookie
 
-		if grokResp.ResponseID != "" {
-			responseID = grokResp.ResponseID
-		}
+	send := func(chunk ChatCompletionChunk) {
+		chunk.ID = opts.ID
+		chunk.Choices[0].Index = c.Index
+		out <- chunk
+	}
+	finish := func(reason string) {
+		final := createChunk(opts.Model, "", "", true, false)
+		final.Choices[0].FinishReason = stringPtr(reason)
+		send(final)
+	}
 
-		// 只收集最终图片（progress=100），过滤掉中间的 part 图片
-		if grokResp.StreamingImageGenerationResponse != nil && grokResp.StreamingImageGenerationResponse.ImageURL != "" {
-			if grokResp.StreamingImageGenerationResponse.Progress == 100 {
-				imageURLs = append(imageURLs, grokResp.StreamingImageGenerationResponse.ImageURL)
-			}
-		}
-		if grokResp.CachedImageGenerationResponse != nil && grokResp.CachedImageGenerationResponse.ImageURL != "" {
-			imageURLs = append(imageURLs, grokResp.CachedImageGenerationResponse.ImageURL)
-		}
+	if c.Err != nil {
+		LogWarn("Choice %d failed: %v", c.Index, c.Err)
+		finish("error")
+		return Usage{}, true, false
+	}
 
-		isThinkingContent := grokResp.IsThinking && grokResp.MessageTag != "header"
-		isSearchResult := grokResp.MessageTag == "raw_function_result" && grokResp.WebSearchResults != nil
+	outcome := runChoice(c.Resp.Body, opts, func(ev StreamEvent) {
+		send(eventChunk(opts.Model, ev, opts.ReasoningFormat))
+	})
 
-		if isThinkingContent || isSearchResult {
-			content := processToolResponse(grokResp)
-			if content != "" {
-				writeSSE(w, createChunk(model, "", content, false, false))
-				flusher.Flush()
+	if outcome.UpstreamError {
+		// 多路时只结束该候选，不影响其他候选
+		if multi {
+			finish("error")
+		} else {
+			errType := "upstream_error"
+			if outcome.RateLimited {
+				errType = "rate_limit_error"
 			}
-		}
-
-		if !grokResp.IsThinking && grokResp.MessageTag != "tool_usage_card" && grokResp.MessageTag != "header" && grokResp.MessageTag != "raw_function_result" {
-			content := processToolResponse(grokResp)
-			if content != "" {
-				writeSSE(w, createChunk(model, content, "", false, false))
-				flusher.Flush()
+			out <- map[string]interface{}{
+				"error": map[string]string{
+					"message": upstreamFailure(outcome.RateLimited).Error(),
+					"type":    errType,
+				},
 			}
 		}
+		return Usage{}, true, false
 	}
+	finish(outcome.FinishReason)
 
-	// 检查扫描器是否因错误而退出
-	if err := scanner.Err(); err != nil {
-		LogError("Scanner error while reading upstream response: %v", err)
-	}
-
-	// 分享会话以公开图片访问权限
-	if len(imageURLs) > 0 && conversationID != "" && responseID != "" {
-		if err := shareConversation(conversationID, responseID, cookie); err != nil {
-			LogError("Failed to share conversation: %v", err)
-		} else {
-			LogInfo("Conversation shared successfully: %s", conversationID)
-		}
-
-		for i, imageURL := range imageURLs {
-			fullURL := AssetsURL + "/" + imageURL
-			prefix := "\n"
-			if i == 0 {
-				prefix = "\n\n"
+	// 流式输出无法重试，只在结束时报告校验结果
+	if opts.Structured != nil {
+		if _, err := opts.Structured.validate(outcome.Content); err != nil {
+			LogWarn("Structured output of choice %d failed validation: %v", c.Index, err)
+			message := err.Error()
+			if multi {
+				message = fmt.Sprintf("choice %d: %s", c.Index, message)
+			}
+			out <- map[string]interface{}{
+				"error": map[string]string{
+					"message": message,
+					"type":    "invalid_response_error",
+					"code":    "json_validation_failed",
+				},
 			}
-			content := fmt.Sprintf("%s![image](%s)", prefix, fullURL)
-			writeSSE(w, createChunk(model, content, "", false, false))
-			flusher.Flush()
 		}
 	}
 
-	writeSSE(w, createChunk(model, "", "", true, false))
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	return outcome.Usage, false, outcome.ReadError
 }
 
-func handleNonStreamResponse(w http.ResponseWriter, resp *fhttp.Response, model, cookie string) {
-	scanner := bufio.NewScanner(resp.Body)
-	var finalContent, reasoningContent string
-	var imageURLs []string
-	var conversationID, responseID string
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
-
-		var streamResp GrokStreamResponse
-		if err := json.Unmarshal([]byte(line), &streamResp); err != nil {
-			LogError("Failed to parse upstream response: %v, line: %s", err, line)
-			continue
-		}
-
-		LogDebug("Upstream response: %s", line)
+// choiceOutcome 一路对话输出结束后的状态
+type choiceOutcome struct {
+	Content       string // 输出的完整正文
+	FinishReason  string
+	Usage         Usage
+	UpstreamError bool
+	RateLimited   bool // 上游错误为限流
+	ReadError     bool
+}
 
-		if streamResp.Error != nil {
-			http.Error(w, "RateLimitError", http.StatusTooManyRequests)
+// runChoice 读取上游输出，依次经过 stop/长度限制和思考格式化后交给 emit，各 API 前端共用
+func runChoice(body io.Reader, opts responseOptions, emit func(StreamEvent)) choiceOutcome {
+	var content strings.Builder
+	limiter := newOutputLimiter(opts.Stops, opts.MaxTokens)
+	formatter := newReasoningFormatter(opts.ReasoningFormat)
+	output := func(ev StreamEvent) {
+		ev = formatter.apply(ev)
+		if ev.Content == "" && ev.Reasoning == "" && len(ev.Annotations) == 0 {
 			return
 		}
+		content.WriteString(ev.Content)
+		emit(ev)
+	}
 
-		data := streamResp.Result
-		if data == nil {
-			continue
-		}
+	result := readGrokStream(body, opts.CitationMode, func(ev StreamEvent) bool {
+		output(limiter.push(ev))
+		return !limiter.stopped()
+	})
+	releaseUpstream(body)
 
-		if data.Conversation != nil && data.Conversation.ConversationID != "" {
-			conversationID = data.Conversation.ConversationID
+	if result.UpstreamError {
+		if result.RateLimited {
+			quotas.recordLimited(opts.Cookie, opts.ModelMode)
+		} else {
+			quotas.recordError(opts.Cookie, opts.ModelMode)
 		}
+		return choiceOutcome{UpstreamError: true, RateLimited: result.RateLimited}
+	}
 
-		if data.Response == nil {
-			continue
+	// 生成的图片会破坏 JSON 输出，结构化输出时不追加
+	if !limiter.stopped() && opts.Structured == nil {
+		for _, content := range imageMarkdown(result, opts.Cookie) {
+			output(limiter.push(StreamEvent{Content: content}))
 		}
+	}
+	output(limiter.flush())
+	output(StreamEvent{Content: formatter.finish()})
 
-		grokResp := data.Response
-
-		if grokResp.ResponseID != "" {
-			responseID = grokResp.ResponseID
-		}
+	return choiceOutcome{
+		Content:      content.String(),
+		FinishReason: limiter.FinishReason(),
+		ReadError:    result.ReadError,
+		Usage: Usage{
+			PromptTokens:     opts.PromptTokens,
+			CompletionTokens: limiter.tokens,
+			TotalTokens:      opts.PromptTokens + limiter.tokens,
+		},
+	}
+}
 
-		// 只收集最终图片（progress=100），过滤掉中间的 part 图片
-		if grokResp.StreamingImageGenerationResponse != nil && grokResp.StreamingImageGenerationResponse.ImageURL != "" {
-			if grokResp.StreamingImageGenerationResponse.Progress == 100 {
-				imageURLs = append(imageURLs, grokResp.StreamingImageGenerationResponse.ImageURL)
-			}
-		}
-		if grokResp.CachedImageGenerationResponse != nil && grokResp.CachedImageGenerationResponse.ImageURL != "" {
-			imageURLs = append(imageURLs, grokResp.CachedImageGenerationResponse.ImageURL)
-		}
+// completion 非流式响应的汇总结果
+type completion struct {
+	Message       *MessageResp
+	FinishReason  string
+	Usage         Usage
+	UpstreamError bool
+	RateLimited   bool
+	ReadError     bool
+}
 
-		isThinkingContent := grokResp.IsThinking && grokResp.MessageTag != "header"
-		isSearchResult := grokResp.MessageTag == "raw_function_result" && grokResp.WebSearchResults != nil
+func collectCompletion(resp *fhttp.Response, opts responseOptions) completion {
+	var reasoningContent strings.Builder
+	var annotations []Annotation
 
-		if isThinkingContent || isSearchResult {
-			content := processToolResponse(grokResp)
-			if content != "" {
-				reasoningContent += content
-			}
+	outcome := runChoice(resp.Body, opts, func(ev StreamEvent) {
+		reasoningContent.WriteString(ev.Reasoning)
+		annotations = append(annotations, ev.Annotations...)
+		if opts.Progress != nil {
+			opts.Progress(ev)
 		}
+	})
+	if outcome.UpstreamError {
+		return completion{UpstreamError: true, RateLimited: outcome.RateLimited}
+	}
 
-		if grokResp.Token != "" && !grokResp.IsThinking {
-			finalContent += grokResp.Token
-		}
+	message := &MessageResp{
+		Role:        "assistant",
+		Content:     outcome.Content,
+		Annotations: annotations,
+	}
+	if opts.ReasoningFormat == ReasoningField {
+		message.Reasoning = reasoningContent.String()
+	} else {
+		message.ReasoningContent = reasoningContent.String()
 	}
 
-	// 检查扫描器是否因错误而退出
-	if err := scanner.Err(); err != nil {
-		LogError("Scanner error while reading upstream response: %v", err)
+	return completion{
+		Message:      message,
+		FinishReason: outcome.FinishReason,
+		Usage:        outcome.Usage,
+		ReadError:    outcome.ReadError,
 	}
+}
 
-	if len(imageURLs) > 0 && conversationID != "" && responseID != "" {
-		if err := shareConversation(conversationID, responseID, cookie); err != nil {
-			LogError("Failed to share conversation: %v", err)
-		} else {
-			LogInfo("Conversation shared successfully: %s", conversationID)
-		}
+func handleNonStreamResponse(w http.ResponseWriter, choices []*upstreamChoice, opts responseOptions, send func(cookie string, extra []Message) (*fhttp.Response, error)) {
+	results := make([]completion, len(choices))
+	errs := make([]error, len(choices))
+	var wg sync.WaitGroup
+	for i, c := range choices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = completeChoice(c, opts, send)
+		}()
+	}
+	wg.Wait()
+
+	if err := firstChoiceError(errs); err != nil {
+		writeChoiceError(w, err)
+		return
+	}
 
-		for i, imageURL := range imageURLs {
-			fullURL := AssetsURL + "/" + imageURL
-			prefix := "\n"
-			if i == 0 {
-				prefix = "\n\n"
-			}
-			finalContent += fmt.Sprintf("%s![image](%s)", prefix, fullURL)
-		}
+	chatResp := buildChatResponse(opts, results, errs)
+	// 部分候选失败或读取中断（包括客户端断开导致的取消）时不缓存
+	truncated := slices.ContainsFunc(results, func(c completion) bool { return c.ReadError })
+	if opts.CacheKey != "" && errors.Join(errs...) == nil && !truncated {
+		responses.put(opts.CacheKey, chatResp)
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(chatResp)
+}
+
+// buildChatResponse 汇总各候选的结果，失败的候选以 finish_reason error 返回
+func buildChatResponse(opts responseOptions, results []completion, errs []error) ChatCompletionResponse {
 	chatResp := ChatCompletionResponse{
-		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
+		ID:      opts.ID,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
-		Model:   model,
-		Choices: []Choice{
-			{
-				Index: 0,
-				Message: &MessageResp{
-					Role:             "assistant",
-					Content:          finalContent,
-					ReasoningContent: reasoningContent,
-				},
-				FinishReason: stringPtr("stop"),
-			},
-		},
-		Usage: Usage{
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		},
+		Model:   opts.Model,
+	}
+	usages := make([]Usage, len(results))
+	for i, c := range results {
+		if errs[i] != nil {
+			LogWarn("Choice %d failed: %v", i, errs[i])
+			c = completion{Message: &MessageResp{Role: "assistant"}, FinishReason: "error"}
+		}
+		chatResp.Choices = append(chatResp.Choices, Choice{
+			Index:        i,
+			Message:      c.Message,
+			FinishReason: stringPtr(c.FinishReason),
+		})
+		usages[i] = c.Usage
 	}
+	chatResp.Usage = sumUsage(usages)
+	return chatResp
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	json.NewEncoder(w).Encode(chatResp)
+// completeChoice 汇总一路上游对话，结构化输出校验失败时在同一令牌上重试一次
+func completeChoice(c *upstreamChoice, opts responseOptions, send func(cookie string, extra []Message) (*fhttp.Response, error)) (completion, error) {
+	if c.Err != nil {
+		return completion{}, c.Err
+	}
+	opts.Cookie = c.Cookie
+
+	result := collectCompletion(c.Resp, opts)
+	if opts.Structured != nil && !result.UpstreamError {
+		// 重试前关闭第一次的响应
+		c.Resp.Body.Close()
+		retry := func(extra []Message) (*fhttp.Response, error) {
+			return send(c.Cookie, extra)
+		}
+		var err error
+		if result, err = completeStructured(result, opts, retry); err != nil {
+			return result, &outputValidationError{err}
+		}
+	}
+	if result.UpstreamError {
+		return result, upstreamFailure(result.RateLimited)
+	}
+	return result, nil
 }
 
 func shareConversation(conversationID, responseID, cookie string) error {
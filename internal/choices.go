@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// 上游对话中途返回错误：限流返回 429，审核、参数等其他错误返回 502
+var (
+	errRateLimited    = errors.New("RateLimitError")
+	errUpstreamFailed = errors.New("UpstreamError")
+)
+
+// upstreamFailure 上游错误行对应的错误
+func upstreamFailure(rateLimited bool) error {
+	if rateLimited {
+		return errRateLimited
+	}
+	return errUpstreamFailed
+}
+
+// outputValidationError 结构化输出重试后仍未通过校验
+type outputValidationError struct {
+	err error
+}
+
+func (e *outputValidationError) Error() string {
+	return e.err.Error()
+}
+
+// upstreamChoice 一个候选对应的上游对话
+type upstreamChoice struct {
+	Index  int
+	Cookie string
+	Resp   *fhttp.Response
+	Err    error
+}
+
+// resolveChoiceCount 校验请求参数 n
+func resolveChoiceCount(req *ChatRequest) (int, error) {
+	if req.N == nil {
+		return 1, nil
+	}
+	max := GetConfig().MaxChoices
+	if *req.N < 1 || *req.N > max {
+		return 0, fmt.Errorf("n: must be between 1 and %d, got %d", max, *req.N)
+	}
+	return *req.N, nil
+}
+
+// startChoices 并发发起 n 路上游对话；usePool 时第 2 路起轮流使用令牌池中在该模式下未耗尽的令牌
+func startChoices(n int, cookie, mode string, usePool bool, send func(cookie string) (*fhttp.Response, error)) []*upstreamChoice {
+	choices := make([]*upstreamChoice, n)
+	var wg sync.WaitGroup
+	for i := range choices {
+		c := &upstreamChoice{Index: i, Cookie: cookie}
+		if i > 0 && usePool {
+			if token, _ := nextAvailableToken(mode); token != "" {
+				c.Cookie = BuildCookie(token)
+			}
+		}
+		choices[i] = c
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Resp, c.Err = send(c.Cookie)
+		}()
+	}
+	wg.Wait()
+	return choices
+}
+
+// sumUsage 汇总同一提示词各候选的用量：prompt_tokens 只计一次（取最大值，结构化输出重试会增加），completion_tokens 累加
+func sumUsage(usages []Usage) Usage {
+	var total Usage
+	for _, u := range usages {
+		total.PromptTokens = max(total.PromptTokens, u.PromptTokens)
+		total.CompletionTokens += u.CompletionTokens
+	}
+	total.TotalTokens = total.PromptTokens + total.CompletionTokens
+	return total
+}
+
+// firstChoiceError 所有候选都失败时返回第一个错误，否则返回 nil
+func firstChoiceError(errs []error) error {
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs[0]
+}
+
+// writeChoiceError 按错误类型返回与单路请求一致的错误响应
+func writeChoiceError(w http.ResponseWriter, err error) {
+	var validationErr *outputValidationError
+	var limitErr *rateLimitError
+	switch {
+	case errors.As(err, &limitErr):
+		writeRateLimitError(w, limitErr)
+	case errors.Is(err, errRateLimited):
+		http.Error(w, "RateLimitError", http.StatusTooManyRequests)
+	case errors.Is(err, errUpstreamFailed):
+		http.Error(w, "UpstreamError", http.StatusBadGateway)
+	case errors.As(err, &validationErr):
+		writeError(w, http.StatusBadGateway, "invalid_response_error", "json_validation_failed", err.Error())
+	default:
+		writeUpstreamError(w, err)
+	}
+}
+
+// chatErrorStatus 返回 startChat 或候选错误对应的 HTTP 状态码，供其他 API 前端使用
+func chatErrorStatus(err error) int {
+	var reqErr *requestError
+	var statusErr *upstreamStatusError
+	var validationErr *outputValidationError
+	switch {
+	case errors.As(err, &reqErr):
+		return reqErr.Status
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests
+	case errors.As(err, &statusErr):
+		return statusErr.StatusCode
+	case errors.As(err, &validationErr):
+		return http.StatusBadGateway
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 旧版 /v1/completions 请求与响应
+
+type CompletionRequest struct {
+	Model         string         `json:"model"`
+	Prompt        interface{}    `json:"prompt"` // string 或 []string
+	Suffix        string         `json:"suffix,omitempty"`
+	MaxTokens     *int           `json:"max_tokens,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Echo          bool           `json:"echo,omitempty"`
+	Stop          interface{}    `json:"stop,omitempty"`
+	N             *int           `json:"n,omitempty"`
+	BestOf        *int           `json:"best_of,omitempty"`
+	Logprobs      *int           `json:"logprobs,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+// completionTask 一个 prompt 的一个候选
+type completionTask struct {
+	Index  int // prompt 下标 * n + 候选下标
+	Prompt string
+	Choice *upstreamChoice
+	Run    *chatRun
+}
+
+// parsePrompts 解析 prompt 参数，只支持文本，不支持 token 数组
+func parsePrompts(prompt interface{}) ([]string, error) {
+	switch v := prompt.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		if len(v) == 0 {
+			return nil, fmt.Errorf("prompt: must not be empty")
+		}
+		prompts := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("prompt: token arrays are not supported, pass text prompts instead")
+			}
+			prompts[i] = s
+		}
+		return prompts, nil
+	}
+	return nil, fmt.Errorf("prompt: must be a string or an array of strings")
+}
+
+// HandleCompletions 兼容旧版 OpenAI POST /v1/completions，每个 prompt 作为一次单轮对话发送
+func HandleCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	prompts, err := parsePrompts(req.Prompt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	if req.Suffix != "" {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "",
+			"suffix: insertion is not supported by this model, remove the suffix parameter")
+		return
+	}
+	if req.Logprobs != nil && *req.Logprobs > 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", "logprobs: not supported by the upstream model")
+		return
+	}
+	n := 1
+	if req.N != nil {
+		n = *req.N
+	}
+	if req.BestOf != nil && *req.BestOf > n {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", "best_of: values greater than n are not supported")
+		return
+	}
+	if max := GetConfig().MaxChoices; len(prompts)*n > max {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "",
+			fmt.Sprintf("prompt: %d prompts x n=%d exceeds the limit of %d completions per request", len(prompts), n, max))
+		return
+	}
+
+	token := BearerToken(r)
+	id := fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+
+	var tasks []completionTask
+	var runs []*chatRun
+	defer func() {
+		for _, run := range runs {
+			run.Close()
+		}
+	}()
+	// 所有提示的上游对话共用一个模型并发名额，否则前面的提示占着名额等待读取，后面的提示排队至超时
+	ctx := withSharedSlot(r.Context())
+	for i, prompt := range prompts {
+		chatReq := ChatRequest{
+			Model:     req.Model,
+			Messages:  []Message{{Role: "user", Content: prompt}},
+			Stop:      req.Stop,
+			MaxTokens: req.MaxTokens,
+			N:         req.N,
+			Grok:      &GrokOptions{ReasoningFormat: ReasoningHidden}, // 补全接口只返回正文
+		}
+
+		run, err := startChat(ctx, &chatReq, token)
+		if err != nil {
+			writeChatError(w, err)
+			return
+		}
+		runs = append(runs, run)
+		for _, c := range run.Choices {
+			tasks = append(tasks, completionTask{Index: i*n + c.Index, Prompt: prompt, Choice: c, Run: run})
+		}
+	}
+
+	if req.Stream {
+		streamCompletions(w, id, req, tasks)
+		return
+	}
+
+	results := make([]completion, len(tasks))
+	errs := make([]error, len(tasks))
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = completeChoice(t.Choice, t.Run.Opts, t.Run.Send)
+		}()
+	}
+	wg.Wait()
+
+	if err := firstChoiceError(errs); err != nil {
+		writeChoiceError(w, err)
+		return
+	}
+
+	resp := CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+	usages := make([]Usage, len(tasks))
+	for i, t := range tasks {
+		choice := CompletionChoice{Index: t.Index}
+		if errs[i] != nil {
+			LogWarn("Completion %d failed: %v", t.Index, errs[i])
+			choice.FinishReason = stringPtr("error")
+		} else {
+			c := results[i]
+			choice.Text = c.Message.Content
+			choice.FinishReason = stringPtr(c.FinishReason)
+			usages[i] = c.Usage
+		}
+		if req.Echo {
+			choice.Text = t.Prompt + choice.Text
+		}
+		resp.Choices = append(resp.Choices, choice)
+	}
+	total := sumTaskUsage(tasks, usages)
+	resp.Usage = &total
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// sumTaskUsage 每个 prompt 的 prompt_tokens 只计一次，各 prompt 之间累加
+func sumTaskUsage(tasks []completionTask, usages []Usage) Usage {
+	byRun := make(map[*chatRun][]Usage)
+	var runs []*chatRun
+	for i, t := range tasks {
+		if _, ok := byRun[t.Run]; !ok {
+			runs = append(runs, t.Run)
+		}
+		byRun[t.Run] = append(byRun[t.Run], usages[i])
+	}
+	var total Usage
+	for _, run := range runs {
+		u := sumUsage(byRun[run])
+		total.PromptTokens += u.PromptTokens
+		total.CompletionTokens += u.CompletionTokens
+		total.TotalTokens += u.TotalTokens
+	}
+	return total
+}
+
+func streamCompletions(w http.ResponseWriter, id string, req CompletionRequest, tasks []completionTask) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	chunk := func(index int, text string, finishReason *string) CompletionResponse {
+		return CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: time.Now().Unix(),
+			Model:   req.Model,
+			Choices: []CompletionChoice{{Text: text, Index: index, FinishReason: finishReason}},
+		}
+	}
+
+	if req.Echo {
+		for _, t := range tasks {
+			writeSSE(w, chunk(t.Index, t.Prompt, nil))
+		}
+		flusher.Flush()
+	}
+
+	events := make(chan interface{})
+	usages := make([]Usage, len(tasks))
+	var wg sync.WaitGroup
+	for i, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if t.Choice.Err != nil {
+				LogWarn("Completion %d failed: %v", t.Index, t.Choice.Err)
+				events <- chunk(t.Index, "", stringPtr("error"))
+				return
+			}
+			opts := t.Run.Opts
+			opts.Cookie = t.Choice.Cookie
+			outcome := runChoice(t.Choice.Resp.Body, opts, func(ev StreamEvent) {
+				if ev.Content != "" {
+					events <- chunk(t.Index, ev.Content, nil)
+				}
+			})
+			if outcome.UpstreamError {
+				events <- chunk(t.Index, "", stringPtr("error"))
+				return
+			}
+			usages[i] = outcome.Usage
+			events <- chunk(t.Index, "", stringPtr(outcome.FinishReason))
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	for ev := range events {
+		writeSSE(w, ev)
+		flusher.Flush()
+	}
+
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		total := sumTaskUsage(tasks, usages)
+		resp := chunk(0, "", nil)
+		resp.Choices = []CompletionChoice{}
+		resp.Usage = &total
+		writeSSE(w, resp)
+	}
+
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
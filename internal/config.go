@@ -1,51 +1,573 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	http "github.com/bogdanfinn/fhttp"
 	tls_client "github.com/bogdanfinn/tls-client"
 	"github.com/bogdanfinn/tls-client/profiles"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Port string
+	Port              string   `yaml:"port" json:"port"`
+	LogLevel          string   `yaml:"log_level" json:"log_level"`
+	Tokens            []string `yaml:"sso_tokens" json:"sso_tokens"`                 // 代理自身使用的 sso 令牌池（探活等后台任务）
+	AnonymousUsePool  bool     `yaml:"anonymous_use_pool" json:"anonymous_use_pool"` // 未携带令牌的请求使用令牌池，默认返回 401
+	AdminKey          string   `yaml:"admin_key" json:"admin_key"`                   // 查看令牌池用量等管理接口使用的 Authorization 值，为空时不开放
+	ProbeInterval     int      `yaml:"probe_interval" json:"probe_interval"`         // 上游探活间隔（秒），0 表示关闭
+	DiscoveryInterval int      `yaml:"discovery_interval" json:"discovery_interval"` // 上游模型同步间隔（秒），0 表示关闭
+
+	Timeout              int                 `yaml:"timeout" json:"timeout"` // 上游请求超时（秒）
+	Headers              map[string]string   `yaml:"headers" json:"headers"` // 覆盖或追加的上游请求头
+	ImageGenerationCount int                 `yaml:"image_generation_count" json:"image_generation_count"`
+	DisableSearch        bool                `yaml:"disable_search" json:"disable_search"`
+	MaxChoices           int                 `yaml:"max_choices" json:"max_choices"`                 // 请求参数 n 的上限
+	ChoicesUsePool       bool                `yaml:"choices_use_pool" json:"choices_use_pool"`       // n > 1 时其余对话轮流使用令牌池
+	BatchConcurrency     int                 `yaml:"batch_concurrency" json:"batch_concurrency"`     // 所有批处理共享的并发请求数（重启生效）
+	BatchMaxRetries      int                 `yaml:"batch_max_retries" json:"batch_max_retries"`     // 批处理请求遇到限流或上游错误时的重试次数
+	BatchUsePool         bool                `yaml:"batch_use_pool" json:"batch_use_pool"`           // 批处理请求轮流使用令牌池
+	WebhookSecret        string              `yaml:"webhook_secret" json:"webhook_secret"`           // 异步任务回调的 HMAC 签名密钥，为空时不接受 webhook_url
+	WebhookMaxRetries    int                 `yaml:"webhook_max_retries" json:"webhook_max_retries"` // 回调失败时的重试次数
+	JobRetention         int                 `yaml:"job_retention" json:"job_retention"`             // 异步任务结束后保留的时间（秒）
+	StreamResumeTTL      int                 `yaml:"stream_resume_ttl" json:"stream_resume_ttl"`     // 流式输出在无客户端连接后保留的时间（秒），0 表示不支持续传
+	ResponseCache        ResponseCacheConfig `yaml:"response_cache" json:"response_cache"`
+	RateLimit            RateLimitConfig     `yaml:"rate_limit" json:"rate_limit"`
+	Quota                QuotaConfig         `yaml:"quota" json:"quota"`
+
+	Models                map[string]ModelConfig `yaml:"models" json:"models"`
+	StrictModels          bool                   `yaml:"strict_models" json:"strict_models"` // 拒绝未定义的模型
+	ReasoningEffortModels map[string]string      `yaml:"reasoning_effort_models" json:"reasoning_effort_models"`
+
+	CitationMode    string                `yaml:"citation_mode" json:"citation_mode"`       // 搜索引用展示方式
+	ReasoningFormat string                `yaml:"reasoning_format" json:"reasoning_format"` // 思考内容展示方式
+	Keys            map[string]KeyProfile `yaml:"keys" json:"keys"`                         // 按调用方 Authorization 值配置的偏好
+
+	UploadLimits        map[string]int        `yaml:"upload_limits_mb" json:"upload_limits_mb"`           // 各类附件大小上限（MB）
+	AttachHistory       bool                  `yaml:"attach_history" json:"attach_history"`               // 附加历史消息中的附件，默认只附加最后一条 user 消息的附件
+	UploadConcurrency   int                   `yaml:"upload_concurrency" json:"upload_concurrency"`       // 单个请求的并发上传数
+	UploadCacheTTL      int                   `yaml:"upload_cache_ttl" json:"upload_cache_ttl"`           // 上传结果缓存时间（秒），0 表示不缓存
+	UploadFailurePolicy string                `yaml:"upload_failure_policy" json:"upload_failure_policy"` // drop / fail
+	ImageProcessing     ImageProcessingConfig `yaml:"image_processing" json:"image_processing"`
+	FetchTimeout        int                   `yaml:"fetch_timeout" json:"fetch_timeout"`             // 下载远程图片超时（秒）
+	FetchAllowPrivate   bool                  `yaml:"fetch_allow_private" json:"fetch_allow_private"` // 允许下载内网地址的图片（仅限可信环境）
+	DataDir             string                `yaml:"data_dir" json:"data_dir"`                       // 文件记录等持久化数据目录
+
+	aliases map[string]string // 别名 -> 模型 ID
+}
+
+// KeyProfile 调用方级别的默认设置
+type KeyProfile struct {
+	ReasoningFormat string `yaml:"reasoning_format" json:"reasoning_format"`
+	RPM             int    `yaml:"rpm" json:"rpm"` // 覆盖 rate_limit.client_rpm
 }
 
-var Cfg *Config
+var (
+	cfgValue   atomic.Pointer[Config]
+	configPath string
+)
+
+// GetConfig 返回当前生效的配置快照，热重载时整体替换，不影响正在处理的请求
+func GetConfig() *Config {
+	return cfgValue.Load()
+}
 
-func LoadConfig() {
+func defaultConfig() *Config {
+	models := make(map[string]ModelConfig, len(DefaultModelMapping))
+	for id, m := range DefaultModelMapping {
+		models[id] = m
+	}
+
+	return &Config{
+		Port:                 "8080",
+		LogLevel:             "INFO",
+		Timeout:              600,
+		ImageGenerationCount: 2,
+		MaxChoices:           4,
+		BatchConcurrency:     4,
+		BatchMaxRetries:      3,
+		WebhookMaxRetries:    5,
+		JobRetention:         3600,
+		ResponseCache: ResponseCacheConfig{
+			TTL:    3600,
+			MaxMB:  64,
+			DiskMB: 256,
+		},
+		RateLimit: RateLimitConfig{
+			ClientRPM:    60,
+			ClientBurst:  10,
+			TokenRPM:     20,
+			TokenBurst:   5,
+			QueueTimeout: 30,
+		},
+		Quota: QuotaConfig{
+			Window: 7200,
+		},
+		CitationMode:      CitationMarkdown,
+		DataDir:           "data",
+		UploadConcurrency: 4,
+		FetchTimeout:      15,
+		ImageProcessing: ImageProcessingConfig{
+			Enabled:            true,
+			MaxDimension:       2048,
+			LowDetailDimension: 512,
+			Format:             "auto",
+			JPEGQuality:        85,
+			MaxInputMB:         50,
+		},
+		UploadCacheTTL:      3600,
+		UploadFailurePolicy: UploadPolicyDrop,
+		UploadLimits: map[string]int{
+			"image":    20,
+			"pdf":      50,
+			"document": 20,
+			"text":     10,
+		},
+		ReasoningFormat: ReasoningContentField,
+		ReasoningEffortModels: map[string]string{
+			"minimal": "grok-4-fast",
+			"low":     "grok-4-fast",
+			"medium":  "grok-4.1-thinking",
+			"high":    "grok-4.1-thinking",
+		},
+		Models: models,
+	}
+}
+
+// LoadConfig 依次加载默认值、配置文件和环境变量，校验失败时返回错误
+func LoadConfig() error {
 	godotenv.Load()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	configPath = os.Getenv("CONFIG_FILE")
+	if configPath == "" {
+		for _, name := range []string{"config.yaml", "config.yml", "config.json"} {
+			if _, err := os.Stat(name); err == nil {
+				configPath = name
+				break
+			}
+		}
+	}
+
+	cfg, err := buildConfig()
+	if err != nil {
+		return err
+	}
+
+	cfgValue.Store(cfg)
+	return nil
+}
+
+func buildConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	if configPath != "" {
+		if err := loadConfigFile(configPath, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnvOverrides(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
 	}
 
-	Cfg = &Config{
-		Port: port,
+	cfg.aliases = make(map[string]string)
+	for id, m := range cfg.Models {
+		for _, alias := range m.Aliases {
+			cfg.aliases[alias] = id
+		}
 	}
+
+	return cfg, nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open config file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	// 配置文件中的 models 整体替换内置模型表
+	cfg.Models = nil
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	} else {
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	if cfg.Models == nil {
+		cfg.Models = defaultConfig().Models
+	}
+	return nil
+}
+
+func applyEnvOverrides(cfg *Config) error {
+	if v := os.Getenv("PORT"); v != "" {
+		cfg.Port = v
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := os.Getenv("UPLOAD_FAILURE_POLICY"); v != "" {
+		cfg.UploadFailurePolicy = v
+	}
+	if v := os.Getenv("DATA_DIR"); v != "" {
+		cfg.DataDir = v
+	}
+	if v := os.Getenv("WEBHOOK_SECRET"); v != "" {
+		cfg.WebhookSecret = v
+	}
+	if v := os.Getenv("ADMIN_KEY"); v != "" {
+		cfg.AdminKey = v
+	}
+	if v := os.Getenv("CITATION_MODE"); v != "" {
+		cfg.CitationMode = v
+	}
+	if v := os.Getenv("REASONING_FORMAT"); v != "" {
+		cfg.ReasoningFormat = v
+	}
+	if v := os.Getenv("SSO_TOKENS"); v != "" {
+		cfg.Tokens = nil
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				cfg.Tokens = append(cfg.Tokens, t)
+			}
+		}
+	}
+
+	intEnvs := map[string]*int{
+		"PROBE_INTERVAL":               &cfg.ProbeInterval,
+		"DISCOVERY_INTERVAL":           &cfg.DiscoveryInterval,
+		"TIMEOUT":                      &cfg.Timeout,
+		"IMAGE_GENERATION_COUNT":       &cfg.ImageGenerationCount,
+		"MAX_CHOICES":                  &cfg.MaxChoices,
+		"BATCH_CONCURRENCY":            &cfg.BatchConcurrency,
+		"BATCH_MAX_RETRIES":            &cfg.BatchMaxRetries,
+		"WEBHOOK_MAX_RETRIES":          &cfg.WebhookMaxRetries,
+		"JOB_RETENTION":                &cfg.JobRetention,
+		"STREAM_RESUME_TTL":            &cfg.StreamResumeTTL,
+		"RESPONSE_CACHE_TTL":           &cfg.ResponseCache.TTL,
+		"RATE_LIMIT_CLIENT_RPM":        &cfg.RateLimit.ClientRPM,
+		"RATE_LIMIT_TOKEN_RPM":         &cfg.RateLimit.TokenRPM,
+		"RATE_LIMIT_MODEL_CONCURRENCY": &cfg.RateLimit.ModelConcurrency,
+		"QUOTA_WINDOW":                 &cfg.Quota.Window,
+		"QUOTA_QUERY_INTERVAL":         &cfg.Quota.QueryInterval,
+		"UPLOAD_CONCURRENCY":           &cfg.UploadConcurrency,
+		"UPLOAD_CACHE_TTL":             &cfg.UploadCacheTTL,
+		"FETCH_TIMEOUT":                &cfg.FetchTimeout,
+	}
+	for name, target := range intEnvs {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("env %s: invalid integer %q", name, v)
+			}
+			*target = n
+		}
+	}
+
+	boolEnvs := map[string]*bool{
+		"DISABLE_SEARCH":      &cfg.DisableSearch,
+		"STRICT_MODELS":       &cfg.StrictModels,
+		"FETCH_ALLOW_PRIVATE": &cfg.FetchAllowPrivate,
+		"ATTACH_HISTORY":      &cfg.AttachHistory,
+		"CHOICES_USE_POOL":    &cfg.ChoicesUsePool,
+		"BATCH_USE_POOL":      &cfg.BatchUsePool,
+		"ANONYMOUS_USE_POOL":  &cfg.AnonymousUsePool,
+		"RESPONSE_CACHE":      &cfg.ResponseCache.Enabled,
+		"RATE_LIMIT":          &cfg.RateLimit.Enabled,
+	}
+	for name, target := range boolEnvs {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("env %s: invalid boolean %q", name, v)
+			}
+			*target = b
+		}
+	}
+
+	return nil
+}
+
+// Validate 校验配置，返回所有问题而不是只返回第一个
+func (c *Config) Validate() error {
+	var errs []error
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port: must be a number between 1 and 65535, got %q", c.Port))
+	}
+	if _, ok := parseLogLevel(c.LogLevel); !ok {
+		errs = append(errs, fmt.Errorf("log_level: must be one of DEBUG, INFO, WARN, ERROR, got %q", c.LogLevel))
+	}
+	if !validCitationMode(c.CitationMode) {
+		errs = append(errs, fmt.Errorf("citation_mode: must be one of markdown, annotations, inline, got %q", c.CitationMode))
+	}
+	if !validReasoningFormat(c.ReasoningFormat) {
+		errs = append(errs, fmt.Errorf("reasoning_format: must be one of reasoning_content, think, reasoning, hidden, got %q", c.ReasoningFormat))
+	}
+	if c.MaxChoices < 1 {
+		errs = append(errs, fmt.Errorf("max_choices: must be >= 1, got %d", c.MaxChoices))
+	}
+	if c.BatchConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("batch_concurrency: must be >= 1, got %d", c.BatchConcurrency))
+	}
+	if c.BatchMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("batch_max_retries: must be >= 0, got %d", c.BatchMaxRetries))
+	}
+	if c.WebhookMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("webhook_max_retries: must be >= 0, got %d", c.WebhookMaxRetries))
+	}
+	if c.JobRetention < 1 {
+		errs = append(errs, fmt.Errorf("job_retention: must be >= 1, got %d", c.JobRetention))
+	}
+	if c.StreamResumeTTL < 0 {
+		errs = append(errs, fmt.Errorf("stream_resume_ttl: must be >= 0, got %d", c.StreamResumeTTL))
+	}
+	if c.UploadConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("upload_concurrency: must be >= 1, got %d", c.UploadConcurrency))
+	}
+	if c.UploadCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("upload_cache_ttl: must be >= 0, got %d", c.UploadCacheTTL))
+	}
+	if c.UploadFailurePolicy != UploadPolicyDrop && c.UploadFailurePolicy != UploadPolicyFail {
+		errs = append(errs, fmt.Errorf("upload_failure_policy: must be drop or fail, got %q", c.UploadFailurePolicy))
+	}
+	if rc := c.ResponseCache; rc.Enabled {
+		if rc.TTL < 1 {
+			errs = append(errs, fmt.Errorf("response_cache.ttl: must be >= 1, got %d", rc.TTL))
+		}
+		if rc.MaxMB < 1 {
+			errs = append(errs, fmt.Errorf("response_cache.max_mb: must be >= 1, got %d", rc.MaxMB))
+		}
+		if rc.Disk && rc.DiskMB < 1 {
+			errs = append(errs, fmt.Errorf("response_cache.disk_mb: must be >= 1, got %d", rc.DiskMB))
+		}
+	}
+	if rl := c.RateLimit; rl.Enabled {
+		for name, v := range map[string]int{
+			"client_rpm":        rl.ClientRPM,
+			"token_rpm":         rl.TokenRPM,
+			"model_concurrency": rl.ModelConcurrency,
+			"queue_timeout":     rl.QueueTimeout,
+		} {
+			if v < 0 {
+				errs = append(errs, fmt.Errorf("rate_limit.%s: must be >= 0, got %d", name, v))
+			}
+		}
+		if rl.ClientRPM > 0 && rl.ClientBurst < 1 {
+			errs = append(errs, fmt.Errorf("rate_limit.client_burst: must be >= 1, got %d", rl.ClientBurst))
+		}
+		if rl.TokenRPM > 0 && rl.TokenBurst < 1 {
+			errs = append(errs, fmt.Errorf("rate_limit.token_burst: must be >= 1, got %d", rl.TokenBurst))
+		}
+	}
+	if c.Quota.Window < 1 {
+		errs = append(errs, fmt.Errorf("quota.window: must be >= 1, got %d", c.Quota.Window))
+	}
+	if c.Quota.QueryInterval < 0 {
+		errs = append(errs, fmt.Errorf("quota.query_interval: must be >= 0, got %d", c.Quota.QueryInterval))
+	}
+	if ip := c.ImageProcessing; ip.Enabled {
+		if ip.MaxDimension < 0 {
+			errs = append(errs, fmt.Errorf("image_processing.max_dimension: must be >= 0, got %d", ip.MaxDimension))
+		}
+		if ip.MaxInputMB < 0 {
+			errs = append(errs, fmt.Errorf("image_processing.max_input_mb: must be >= 0, got %d", ip.MaxInputMB))
+		}
+		if ip.LowDetailDimension < 0 {
+			errs = append(errs, fmt.Errorf("image_processing.low_detail_dimension: must be >= 0, got %d", ip.LowDetailDimension))
+		}
+		if ip.Format != "auto" && ip.Format != "jpeg" && ip.Format != "png" {
+			errs = append(errs, fmt.Errorf("image_processing.format: must be auto, jpeg or png, got %q", ip.Format))
+		}
+		if ip.JPEGQuality < 1 || ip.JPEGQuality > 100 {
+			errs = append(errs, fmt.Errorf("image_processing.jpeg_quality: must be between 1 and 100, got %d", ip.JPEGQuality))
+		}
+	}
+	if c.FetchTimeout < 1 {
+		errs = append(errs, fmt.Errorf("fetch_timeout: must be >= 1, got %d", c.FetchTimeout))
+	}
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data_dir: required"))
+	}
+	for kind, mb := range c.UploadLimits {
+		switch kind {
+		case "image", "pdf", "document", "text":
+		default:
+			errs = append(errs, fmt.Errorf("upload_limits_mb.%s: unknown kind, must be one of image, pdf, document, text", kind))
+		}
+		if mb < 0 {
+			errs = append(errs, fmt.Errorf("upload_limits_mb.%s: must be >= 0, got %d", kind, mb))
+		}
+	}
+	for key, p := range c.Keys {
+		if p.ReasoningFormat != "" && !validReasoningFormat(p.ReasoningFormat) {
+			errs = append(errs, fmt.Errorf("keys.%s.reasoning_format: must be one of reasoning_content, think, reasoning, hidden, got %q", maskToken(key), p.ReasoningFormat))
+		}
+		if p.RPM < 0 {
+			errs = append(errs, fmt.Errorf("keys.%s.rpm: must be >= 0, got %d", maskToken(key), p.RPM))
+		}
+	}
+	if c.ProbeInterval < 0 {
+		errs = append(errs, fmt.Errorf("probe_interval: must be >= 0, got %d", c.ProbeInterval))
+	}
+	if c.DiscoveryInterval < 0 {
+		errs = append(errs, fmt.Errorf("discovery_interval: must be >= 0, got %d", c.DiscoveryInterval))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("timeout: must be > 0, got %d", c.Timeout))
+	}
+	if c.ImageGenerationCount < 1 || c.ImageGenerationCount > maxImageGenerationCount {
+		errs = append(errs, fmt.Errorf("image_generation_count: must be between 1 and %d, got %d", maxImageGenerationCount, c.ImageGenerationCount))
+	}
+	if len(c.Models) == 0 {
+		errs = append(errs, errors.New("models: at least one model is required"))
+	}
+	aliasOwners := map[string]string{}
+	for id, m := range c.Models {
+		if m.ModelName == "" {
+			errs = append(errs, fmt.Errorf("models.%s.model_name: required", id))
+		}
+		if !strings.HasPrefix(m.ModelMode, "MODEL_MODE_") {
+			errs = append(errs, fmt.Errorf("models.%s.model_mode: must start with MODEL_MODE_, got %q", id, m.ModelMode))
+		}
+		if n := m.Defaults.ImageGenerationCount; n != nil && (*n < 1 || *n > maxImageGenerationCount) {
+			errs = append(errs, fmt.Errorf("models.%s.defaults.image_generation_count: must be between 1 and %d, got %d", id, maxImageGenerationCount, *n))
+		}
+		if n := m.Limits.MaxImageCount; n < 0 || n > maxImageGenerationCount {
+			errs = append(errs, fmt.Errorf("models.%s.limits.max_image_count: must be between 0 and %d, got %d", id, maxImageGenerationCount, n))
+		}
+		for _, alias := range m.Aliases {
+			if _, ok := c.Models[alias]; ok {
+				errs = append(errs, fmt.Errorf("models.%s.aliases: %q conflicts with a model id", id, alias))
+			} else if owner, ok := aliasOwners[alias]; ok {
+				errs = append(errs, fmt.Errorf("models.%s.aliases: %q is already an alias of %s", id, alias, owner))
+			}
+			aliasOwners[alias] = id
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ResolveModel 按模型 ID 或别名查找模型配置，返回规范的模型 ID
+func (c *Config) ResolveModel(name string) (string, ModelConfig, bool) {
+	if m, ok := c.Models[name]; ok {
+		return name, m, true
+	}
+	if id, ok := c.aliases[name]; ok {
+		return id, c.Models[id], true
+	}
+	return "", ModelConfig{}, false
+}
+
+// WatchConfig 在收到 SIGHUP 或配置文件变更时重新加载配置
+func WatchConfig() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		var lastMod time.Time
+		if info, err := os.Stat(configPath); configPath != "" && err == nil {
+			lastMod = info.ModTime()
+		}
+
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sighup:
+				LogInfo("Received SIGHUP, reloading config")
+				reloadConfig()
+			case <-ticker.C:
+				if configPath == "" {
+					continue
+				}
+				info, err := os.Stat(configPath)
+				if err != nil || !info.ModTime().After(lastMod) {
+					continue
+				}
+				lastMod = info.ModTime()
+				LogInfo("Config file %s changed, reloading", configPath)
+				reloadConfig()
+			}
+		}
+	}()
+}
+
+func reloadConfig() {
+	cfg, err := buildConfig()
+	if err != nil {
+		LogError("Config reload failed, keeping current config: %v", err)
+		return
+	}
+
+	old := cfgValue.Swap(cfg)
+	if old != nil && old.Port != cfg.Port {
+		LogWarn("Port change from %s to %s requires a restart", old.Port, cfg.Port)
+	}
+	InitLogger()
+	LogInfo("Config reloaded, %d models", len(cfg.Models))
 }
 
 // 固定请求头
+var DefaultHeaders = map[string]string{
+	"Accept":             "*/*",
+	"Accept-Language":    "zh-CN,zh;q=0.9",
+	"Baggage":            "sentry-public_key=b311e0f2690c81f25e2c4cf6d4f7ce1c",
+	"Connection":         "keep-alive",
+	"Origin":             "https://grok.com",
+	"Priority":           "u=1, i",
+	"Referer":            "https://grok.com/",
+	"Sec-Ch-Ua":          `"Not(A:Brand";v="99", "Google Chrome";v="133", "Chromium";v="133"`,
+	"Sec-Ch-Ua-Mobile":   "?0",
+	"Sec-Ch-Ua-Platform": `"macOS"`,
+	"Sec-Fetch-Dest":     "empty",
+	"Sec-Fetch-Mode":     "cors",
+	"Sec-Fetch-Site":     "same-origin",
+	"User-Agent":         "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36",
+	"x-statsig-id":       "ZTpUeXBlRXJyb3I6IENhbm5vdCByZWFkIHByb3BlcnRpZXMgb2YgdW5kZWZpbmVkIChyZWFkaW5nICdjaGlsZE5vZGVzJyk=",
+}
+
 func SetCommonHeaders(req *http.Request) {
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
-	req.Header.Set("Baggage", "sentry-public_key=b311e0f2690c81f25e2c4cf6d4f7ce1c")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Origin", "https://grok.com")
-	req.Header.Set("Priority", "u=1, i")
-	req.Header.Set("Referer", "https://grok.com/")
-	req.Header.Set("Sec-Ch-Ua", `"Not(A:Brand";v="99", "Google Chrome";v="133", "Chromium";v="133"`)
-	req.Header.Set("Sec-Ch-Ua-Mobile", "?0")
-	req.Header.Set("Sec-Ch-Ua-Platform", `"macOS"`)
-	req.Header.Set("Sec-Fetch-Dest", "empty")
-	req.Header.Set("Sec-Fetch-Mode", "cors")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/133.0.0.0 Safari/537.36")
-	req.Header.Set("x-statsig-id", "ZTpUeXBlRXJyb3I6IENhbm5vdCByZWFkIHByb3BlcnRpZXMgb2YgdW5kZWZpbmVkIChyZWFkaW5nICdjaGlsZE5vZGVzJyk=")
+	for k, v := range DefaultHeaders {
+		req.Header.Set(k, v)
+	}
+	// 配置中的请求头覆盖默认值，空值表示删除
+	for k, v := range GetConfig().Headers {
+		if v == "" {
+			req.Header.Del(k)
+			continue
+		}
+		req.Header.Set(k, v)
+	}
 	req.Header.Set("x-xai-request-id", uuid.New().String())
 }
 
@@ -66,7 +588,7 @@ func SetUploadHeaders(req *http.Request, cookie string) {
 // TLS 客户端（伪装成 Chrome 浏览器）
 func GetHTTPClient() tls_client.HttpClient {
 	options := []tls_client.HttpClientOption{
-		tls_client.WithTimeoutSeconds(600),
+		tls_client.WithTimeoutSeconds(GetConfig().Timeout),
 		tls_client.WithClientProfile(profiles.Chrome_131),
 		tls_client.WithRandomTLSExtensionOrder(), // 随机 TLS 扩展顺序，必须启用
 	}
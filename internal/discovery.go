@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// Grok 模型列表接口响应
+type GrokModelsResponse struct {
+	Models []GrokModel `json:"models"`
+}
+
+type GrokModel struct {
+	ModelID     string `json:"modelId"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ModelMode   string `json:"modelMode"`
+}
+
+// 上游发现的模型，发现失败时保留上一次的结果
+var discovery struct {
+	sync.RWMutex
+	models    map[string]ModelConfig
+	firstSeen map[string]int64
+	fetchedAt time.Time
+}
+
+// StartModelDiscovery 周期性从上游同步模型列表，间隔随配置热重载生效
+func StartModelDiscovery() {
+	go func() {
+		for {
+			cfg := GetConfig()
+			if cfg.DiscoveryInterval <= 0 || len(cfg.Tokens) == 0 {
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			if err := discoverModels(NextPoolToken()); err != nil {
+				LogWarn("Model discovery failed, serving last known models: %v", err)
+			}
+
+			time.Sleep(time.Duration(cfg.DiscoveryInterval) * time.Second)
+		}
+	}()
+}
+
+func discoverModels(token string) error {
+	req, err := fhttp.NewRequest("POST", BaseURL+"/rest/models", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return err
+	}
+
+	SetChatHeaders(req, BuildCookie(token))
+
+	client := GetHTTPClient()
+	if client == nil {
+		return fmt.Errorf("failed to create TLS client")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		LogDebug("Model discovery failed - Status: %d, Response: %s", resp.StatusCode, string(bodyBytes))
+		return fmt.Errorf("list models failed: status %d", resp.StatusCode)
+	}
+
+	var modelsResp GrokModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&modelsResp); err != nil {
+		return err
+	}
+	if len(modelsResp.Models) == 0 {
+		return fmt.Errorf("upstream returned no models")
+	}
+
+	now := time.Now()
+	models := make(map[string]ModelConfig, len(modelsResp.Models))
+
+	discovery.Lock()
+	defer discovery.Unlock()
+
+	if discovery.firstSeen == nil {
+		discovery.firstSeen = make(map[string]int64)
+	}
+	for _, m := range modelsResp.Models {
+		if m.ModelID == "" {
+			continue
+		}
+		if _, ok := discovery.firstSeen[m.ModelID]; !ok {
+			discovery.firstSeen[m.ModelID] = now.Unix()
+		}
+		mode := m.ModelMode
+		if mode == "" {
+			mode = "MODEL_MODE_AUTO"
+		}
+		models[m.ModelID] = ModelConfig{
+			ModelName:   m.ModelID,
+			ModelMode:   mode,
+			DisplayName: m.Name,
+			Description: m.Description,
+			OwnedBy:     "xai",
+			Created:     discovery.firstSeen[m.ModelID],
+		}
+	}
+
+	discovery.models = models
+	discovery.fetchedAt = now
+	LogInfo("Discovered %d upstream models", len(models))
+	return nil
+}
+
+// mergeModelConfig 用配置中的非零字段覆盖上游发现的模型
+func mergeModelConfig(base, override ModelConfig) ModelConfig {
+	if override.ModelName != "" {
+		base.ModelName = override.ModelName
+	}
+	if override.ModelMode != "" {
+		base.ModelMode = override.ModelMode
+	}
+	if len(override.Aliases) > 0 {
+		base.Aliases = override.Aliases
+	}
+	if override.DisplayName != "" {
+		base.DisplayName = override.DisplayName
+	}
+	if override.Description != "" {
+		base.Description = override.Description
+	}
+	if override.OwnedBy != "" {
+		base.OwnedBy = override.OwnedBy
+	}
+	if override.Created != 0 {
+		base.Created = override.Created
+	}
+	base.Defaults = override.Defaults
+	base.Limits = override.Limits
+	return base
+}
+
+// ModelCatalog 返回配置模型与上游发现模型合并后的模型表
+func ModelCatalog() map[string]ModelConfig {
+	cfg := GetConfig()
+
+	discovery.RLock()
+	defer discovery.RUnlock()
+
+	catalog := make(map[string]ModelConfig, len(cfg.Models)+len(discovery.models))
+	for id, m := range discovery.models {
+		catalog[id] = m
+	}
+	for id, m := range cfg.Models {
+		if base, ok := catalog[id]; ok {
+			catalog[id] = mergeModelConfig(base, m)
+		} else {
+			catalog[id] = m
+		}
+	}
+	return catalog
+}
+
+// LookupModel 按模型 ID 或别名在合并后的模型表中查找
+func LookupModel(name string) (string, ModelConfig, bool) {
+	cfg := GetConfig()
+	if id, m, ok := cfg.ResolveModel(name); ok {
+		discovery.RLock()
+		base, discovered := discovery.models[id]
+		discovery.RUnlock()
+		if discovered {
+			m = mergeModelConfig(base, m)
+		}
+		return id, m, true
+	}
+
+	discovery.RLock()
+	defer discovery.RUnlock()
+	if m, ok := discovery.models[name]; ok {
+		return name, m, true
+	}
+	return "", ModelConfig{}, false
+}
+
+func HandleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	catalog := ModelCatalog()
+	ids := make([]string, 0, len(catalog))
+	for id := range catalog {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var models []ModelInfo
+	for _, id := range ids {
+		models = append(models, newModelInfo(id, catalog[id]))
+	}
+
+	resp := ModelsResponse{
+		Object: "list",
+		Data:   models,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleModel 查询单个模型，支持别名
+func HandleModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("id")
+	id, m, ok := LookupModel(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			fmt.Sprintf("The model `%s` does not exist", name))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newModelInfo(id, m))
+}
+
+func newModelInfo(id string, m ModelConfig) ModelInfo {
+	info := ModelInfo{
+		ID:          id,
+		Object:      "model",
+		Created:     m.Created,
+		OwnedBy:     m.OwnedBy,
+		Name:        m.DisplayName,
+		Description: m.Description,
+		Aliases:     m.Aliases,
+	}
+	if info.Created == 0 {
+		info.Created = 1700000000
+	}
+	if info.OwnedBy == "" {
+		info.OwnedBy = "grok"
+	}
+	return info
+}
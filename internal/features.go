@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"fmt"
+)
+
+const maxImageGenerationCount = 10
+
+// GrokFeatures 最终发送给上游的功能开关
+type GrokFeatures struct {
+	DisableSearch         bool
+	EnableImageGeneration bool
+	ImageGenerationCount  int
+	ForceConcise          bool
+	IsReasoning           bool
+	DeepSearch            bool
+	ToolOverrides         map[string]interface{}
+}
+
+// FeatureError 请求级功能参数校验错误
+type FeatureError struct {
+	Param   string
+	Message string
+}
+
+func (e *FeatureError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Param, e.Message)
+}
+
+// ResolveFeatures 依次合并全局配置、模型默认值和请求参数，并按模型校验组合是否合法
+func ResolveFeatures(req *ChatRequest, modelConfig ModelConfig) (GrokFeatures, error) {
+	cfg := GetConfig()
+	f := GrokFeatures{
+		DisableSearch:         cfg.DisableSearch,
+		EnableImageGeneration: !modelConfig.Limits.DisableImageGeneration,
+		ImageGenerationCount:  cfg.ImageGenerationCount,
+		ToolOverrides:         map[string]interface{}{},
+	}
+
+	d := modelConfig.Defaults
+	if d.DisableSearch != nil {
+		f.DisableSearch = *d.DisableSearch
+	}
+	if d.ImageGenerationCount != nil {
+		f.ImageGenerationCount = *d.ImageGenerationCount
+	}
+	if d.ForceConcise != nil {
+		f.ForceConcise = *d.ForceConcise
+	}
+	if d.IsReasoning != nil {
+		f.IsReasoning = *d.IsReasoning
+	}
+
+	maxCount := maxImageGenerationCount
+	if modelConfig.Limits.MaxImageCount > 0 {
+		maxCount = modelConfig.Limits.MaxImageCount
+	}
+	if f.ImageGenerationCount > maxCount {
+		f.ImageGenerationCount = maxCount
+	}
+
+	// OpenAI 语义：携带 web_search_options 即开启搜索
+	if ws := req.WebSearchOptions; ws != nil {
+		switch ws.SearchContextSize {
+		case "", "low", "medium", "high":
+		default:
+			return f, &FeatureError{"web_search_options.search_context_size", fmt.Sprintf("must be one of low, medium, high, got %q", ws.SearchContextSize)}
+		}
+		f.DisableSearch = false
+	}
+
+	g := req.Grok
+	if g == nil {
+		return f, nil
+	}
+
+	if g.Search != nil {
+		if !*g.Search && req.WebSearchOptions != nil {
+			return f, &FeatureError{"grok.search", "cannot be false when web_search_options is set"}
+		}
+		f.DisableSearch = !*g.Search
+	}
+
+	if g.ImageGeneration != nil {
+		if *g.ImageGeneration && modelConfig.Limits.DisableImageGeneration {
+			return f, &FeatureError{"grok.image_generation", "image generation is not supported by this model"}
+		}
+		f.EnableImageGeneration = *g.ImageGeneration
+	}
+
+	if g.ImageCount != nil {
+		if !f.EnableImageGeneration {
+			return f, &FeatureError{"grok.image_count", "cannot be set when image generation is disabled"}
+		}
+		if *g.ImageCount < 1 || *g.ImageCount > maxCount {
+			return f, &FeatureError{"grok.image_count", fmt.Sprintf("must be between 1 and %d for this model, got %d", maxCount, *g.ImageCount)}
+		}
+		f.ImageGenerationCount = *g.ImageCount
+	}
+
+	if g.Concise != nil {
+		f.ForceConcise = *g.Concise
+	}
+
+	if g.DeepSearch != nil && *g.DeepSearch {
+		if f.DisableSearch {
+			return f, &FeatureError{"grok.deepsearch", "requires web search to be enabled"}
+		}
+		if modelConfig.Limits.DisableDeepSearch {
+			return f, &FeatureError{"grok.deepsearch", "deep search is not supported by this model"}
+		}
+		f.DeepSearch = true
+	}
+
+	for k, v := range g.ToolOverrides {
+		f.ToolOverrides[k] = v
+	}
+
+	return f, nil
+}
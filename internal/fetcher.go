@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+	"github.com/bogdanfinn/tls-client/profiles"
+)
+
+const maxFetchRedirects = 5
+
+// net.IP 方法未覆盖的保留地址段
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",     // 本网络
+	"100.64.0.0/10", // 运营商级 NAT
+	"192.0.0.0/24",  // IETF 协议分配
+	"198.18.0.0/15", // 基准测试
+	"240.0.0.0/4",   // 保留
+	"64:ff9b::/96",  // NAT64
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// blockedIPReason 返回禁止访问该地址的原因，允许访问时返回空字符串
+func blockedIPReason(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	switch {
+	case ip.IsLoopback():
+		return "loopback address"
+	case ip.IsPrivate():
+		return "private network address"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "link-local address"
+	case ip.IsUnspecified():
+		return "unspecified address"
+	case ip.IsMulticast(), ip.IsInterfaceLocalMulticast():
+		return "multicast address"
+	case ip.Equal(net.IPv4bcast):
+		return "broadcast address"
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return "reserved address"
+		}
+	}
+	return ""
+}
+
+// blockedAddrError 目标地址被 SSRF 防护拦截
+type blockedAddrError struct {
+	Addr   string
+	Reason string
+}
+
+func (e *blockedAddrError) Error() string {
+	return fmt.Sprintf("destination %s is not allowed (%s)", e.Addr, e.Reason)
+}
+
+// 在 DNS 解析之后、建立连接之前检查目标 IP，重定向和 DNS 重绑定同样受限
+func ssrfControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &blockedAddrError{Addr: address, Reason: "unresolved address"}
+	}
+	if reason := blockedIPReason(ip); reason != "" {
+		return &blockedAddrError{Addr: address, Reason: reason}
+	}
+	return nil
+}
+
+// fetchDialControl 下载远程图片时的连接检查，测试中替换以放行本地测试服务器
+var fetchDialControl = ssrfControl
+
+func newFetchClient(timeout time.Duration) (tls_client.HttpClient, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if !GetConfig().FetchAllowPrivate {
+		dialer.Control = fetchDialControl
+	}
+
+	options := []tls_client.HttpClientOption{
+		tls_client.WithTimeoutSeconds(int(timeout / time.Second)),
+		tls_client.WithClientProfile(profiles.Chrome_131),
+		tls_client.WithRandomTLSExtensionOrder(),
+		tls_client.WithDialer(dialer),
+		tls_client.WithCustomRedirectFunc(func(req *fhttp.Request, via []*fhttp.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		}),
+	}
+	return tls_client.NewHttpClient(tls_client.NewNoopLogger(), options...)
+}
+
+// fetchRemoteImage 安全地下载远程图片：拦截内网地址，限制大小和超时，并校验图片魔数
+func fetchRemoteImage(rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", &AttachmentError{fmt.Sprintf("invalid image URL %q", rawURL)}
+	}
+
+	cfg := GetConfig()
+	timeout := time.Duration(cfg.FetchTimeout) * time.Second
+	maxBytes := imageInputLimit()
+
+	client, err := newFetchClient(timeout)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := fhttp.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, "", &AttachmentError{fmt.Sprintf("invalid image URL %q: %v", rawURL, err)}
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var blocked *blockedAddrError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &blocked):
+			return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: %v", u.Host, blocked)}
+		case strings.Contains(err.Error(), "is not allowed ("):
+			// 部分错误未使用 %w 包装，只能按消息判断
+			return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: destination is not allowed", u.Host)}
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: timed out after %s", u.Host, timeout)}
+		}
+		return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: %v", u.Host, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: remote server returned status %d", u.Host, resp.StatusCode)}
+	}
+
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+	if contentType != "" && !strings.HasPrefix(contentType, "image/") && contentType != "application/octet-stream" {
+		return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: content type %s is not an image", u.Host, contentType)}
+	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: size %d bytes exceeds limit of %d MB", u.Host, resp.ContentLength, maxBytes>>20)}
+	}
+
+	reader := io.Reader(resp.Body)
+	if maxBytes > 0 {
+		reader = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: read body: %v", u.Host, err)}
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: body exceeds limit of %d MB", u.Host, maxBytes>>20)}
+	}
+
+	sniffed := strings.Split(http.DetectContentType(data), ";")[0]
+	if supportedFileTypes[sniffed].Kind != "image" {
+		return nil, "", &AttachmentError{fmt.Sprintf("fetch image %s: body is %s, not a supported image", u.Host, sniffed)}
+	}
+
+	return data, sniffed, nil
+}
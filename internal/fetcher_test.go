@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// 1x1 PNG
+var testPNG = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+	0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4, 0x89, 0x00, 0x00, 0x00,
+	0x0d, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x63, 0x00, 0x01, 0x00, 0x00,
+	0x05, 0x00, 0x01, 0x0d, 0x0a, 0x2d, 0xb4, 0x00, 0x00, 0x00, 0x00, 0x49,
+	0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
+// setFetchConfig 替换当前配置，测试结束后恢复
+func setFetchConfig(t *testing.T, allowPrivate bool, imageLimitMB int) {
+	t.Helper()
+	old := cfgValue.Load()
+	cfg := defaultConfig()
+	cfg.FetchTimeout = 5
+	cfg.FetchAllowPrivate = allowPrivate
+	cfg.UploadLimits = map[string]int{"image": imageLimitMB}
+	cfg.ImageProcessing.MaxInputMB = imageLimitMB
+	cfgValue.Store(cfg)
+	t.Cleanup(func() { cfgValue.Store(old) })
+}
+
+// allowTestServer 只放行测试服务器自身的地址，其余目标仍经过 SSRF 检查
+func allowTestServer(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	addr := srv.Listener.Addr().String()
+	fetchDialControl = func(network, address string, c syscall.RawConn) error {
+		if address == addr {
+			return nil
+		}
+		return ssrfControl(network, address, c)
+	}
+	t.Cleanup(func() { fetchDialControl = ssrfControl })
+}
+
+func TestBlockedIPReason(t *testing.T) {
+	tests := []struct {
+		ip     string
+		reason string
+	}{
+		{"127.0.0.1", "loopback address"},
+		{"::1", "loopback address"},
+		{"10.1.2.3", "private network address"},
+		{"172.16.0.1", "private network address"},
+		{"192.168.1.1", "private network address"},
+		{"fd00::1", "private network address"},
+		{"169.254.169.254", "link-local address"},
+		{"fe80::1", "link-local address"},
+		{"::ffff:127.0.0.1", "loopback address"},
+		{"::ffff:10.0.0.1", "private network address"},
+		{"::ffff:169.254.169.254", "link-local address"},
+		{"0.0.0.0", "unspecified address"},
+		{"100.64.0.1", "reserved address"},
+		{"64:ff9b::a00:1", "reserved address"},
+		{"8.8.8.8", ""},
+		{"2606:4700:4700::1111", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := blockedIPReason(net.ParseIP(tt.ip)); got != tt.reason {
+				t.Errorf("blockedIPReason(%s) = %q, want %q", tt.ip, got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestFetchRemoteImageBlocksPrivateTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+	setFetchConfig(t, false, 1)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"loopback", "http://127.0.0.1:" + port + "/a.png"},
+		{"localhost", "http://localhost:" + port + "/a.png"},
+		{"ipv6 loopback", "http://[::1]:" + port + "/a.png"},
+		{"private", "http://10.0.0.1/a.png"},
+		{"private 192.168", "http://192.168.0.1/a.png"},
+		{"link-local metadata", "http://169.254.169.254/latest/meta-data/"},
+		{"ipv4-mapped ipv6", "http://[::ffff:127.0.0.1]:" + port + "/a.png"},
+		{"ipv4-mapped ipv6 private", "http://[::ffff:10.0.0.1]/a.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := fetchRemoteImage(tt.url)
+			var attErr *AttachmentError
+			if !errors.As(err, &attErr) {
+				t.Fatalf("fetchRemoteImage(%s) error = %v, want AttachmentError", tt.url, err)
+			}
+			if !strings.Contains(err.Error(), "not allowed") {
+				t.Errorf("fetchRemoteImage(%s) error = %q, want destination not allowed", tt.url, err)
+			}
+		})
+	}
+}
+
+func TestFetchRemoteImage(t *testing.T) {
+	large := append(append([]byte{}, testPNG...), bytes.Repeat([]byte{0}, 2<<20)...)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	})
+	mux.HandleFunc("/octet.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(testPNG)
+	})
+	mux.HandleFunc("/redirect-ok", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok.png", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect-private", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://10.0.0.1/a.png", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect-loopback", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://127.0.0.2/a.png", http.StatusFound)
+	})
+	mux.HandleFunc("/large-declared.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+		w.Write(large)
+	})
+	mux.HandleFunc("/large-chunked.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		for i := 0; i < len(large); i += 64 << 10 {
+			w.Write(large[i:min(i+64<<10, len(large))])
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>hello</body></html>"))
+	})
+	mux.HandleFunc("/fake.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("<html><body>not an image</body></html>"))
+	})
+	mux.HandleFunc("/missing.png", http.NotFound)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	setFetchConfig(t, false, 1)
+	allowTestServer(t, srv)
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{"image", "/ok.png", ""},
+		{"octet-stream image", "/octet.png", ""},
+		{"redirect", "/redirect-ok", ""},
+		{"redirect to private", "/redirect-private", "not allowed"},
+		{"redirect to loopback", "/redirect-loopback", "not allowed"},
+		{"content length over limit", "/large-declared.png", "exceeds limit of 1 MB"},
+		{"chunked body over limit", "/large-chunked.png", "exceeds limit of 1 MB"},
+		{"html content type", "/page.html", "content type text/html is not an image"},
+		{"non-image body", "/fake.png", "not a supported image"},
+		{"not found", "/missing.png", "returned status 404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, mimeType, err := fetchRemoteImage(srv.URL + tt.path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("fetchRemoteImage(%s) error = %v", tt.path, err)
+				}
+				if mimeType != "image/png" || !bytes.Equal(data, testPNG) {
+					t.Errorf("fetchRemoteImage(%s) = %d bytes of %s, want the test PNG", tt.path, len(data), mimeType)
+				}
+				return
+			}
+			var attErr *AttachmentError
+			if !errors.As(err, &attErr) {
+				t.Fatalf("fetchRemoteImage(%s) error = %v, want AttachmentError", tt.path, err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("fetchRemoteImage(%s) error = %q, want it to contain %q", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetchRemoteImageInvalidURL(t *testing.T) {
+	setFetchConfig(t, false, 1)
+	for _, raw := range []string{"file:///etc/passwd", "ftp://example.com/a.png", "http://", "://bad"} {
+		t.Run(raw, func(t *testing.T) {
+			var attErr *AttachmentError
+			if _, _, err := fetchRemoteImage(raw); !errors.As(err, &attErr) {
+				t.Errorf("fetchRemoteImage(%s) error = %v, want AttachmentError", raw, err)
+			}
+		})
+	}
+}
+
+func TestFetchRemoteImageAllowPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+	setFetchConfig(t, true, 1)
+
+	if _, _, err := fetchRemoteImage(srv.URL + "/a.png"); err != nil {
+		t.Fatalf("fetchRemoteImage with fetch_allow_private: %v", err)
+	}
+}
@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileObject OpenAI 文件对象
+type FileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+type FileListResponse struct {
+	Object string       `json:"object"`
+	Data   []FileObject `json:"data"`
+}
+
+type FileDeleteResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// storedFile 本地记录的文件，GrokFileID 为上游 fileMetadataId；
+// Local 的文件（批处理输入输出）不上传上游，内容保存在 data_dir/files/<id>
+type storedFile struct {
+	FileObject
+	Owner      string `json:"owner"`
+	MimeType   string `json:"mime_type"`
+	GrokFileID string `json:"grok_file_id,omitempty"`
+	Local      bool   `json:"local,omitempty"`
+}
+
+// fileStore 文件元数据存储，持久化到 data_dir/files.json
+type fileStore struct {
+	mu         sync.RWMutex
+	path       string
+	contentDir string
+	files      map[string]*storedFile
+}
+
+var files *fileStore
+
+// InitFileStore 从数据目录加载文件记录
+func InitFileStore() error {
+	dir := GetConfig().DataDir
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create data dir %s: %w", dir, err)
+	}
+
+	store := &fileStore{
+		path:       filepath.Join(dir, "files.json"),
+		contentDir: filepath.Join(dir, "files"),
+		files:      make(map[string]*storedFile),
+	}
+	if err := os.MkdirAll(store.contentDir, 0o700); err != nil {
+		return fmt.Errorf("create file content dir %s: %w", store.contentDir, err)
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read file store: %w", err)
+	}
+	if len(data) > 0 {
+		var list []*storedFile
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("parse file store %s: %w", store.path, err)
+		}
+		for _, f := range list {
+			store.files[f.ID] = f
+		}
+	}
+
+	files = store
+	LogInfo("Loaded %d files from %s", len(store.files), store.path)
+	return nil
+}
+
+// 调用方标识，只保存令牌摘要
+func ownerID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// save 持久化文件记录，调用方需持有锁
+func (s *fileStore) save() error {
+	list := make([]*storedFile, 0, len(s.files))
+	for _, f := range s.files {
+		list = append(list, f)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// add 登记文件，保存失败时撤销登记
+func (s *fileStore) add(f *storedFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.files[f.ID]
+	s.files[f.ID] = f
+	if err := s.save(); err != nil {
+		if existed {
+			s.files[f.ID] = prev
+		} else {
+			delete(s.files, f.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func newFileID() string {
+	return "file-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// addLocal 保存只在本地使用的文件内容并登记
+func (s *fileStore) addLocal(owner, filename, purpose string, data []byte) (*storedFile, error) {
+	f := &storedFile{
+		FileObject: FileObject{
+			ID:        newFileID(),
+			Object:    "file",
+			Bytes:     len(data),
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+			Status:    "processed",
+		},
+		Owner:    owner,
+		MimeType: "application/jsonl",
+		Local:    true,
+	}
+	if err := os.WriteFile(s.contentPath(f.ID), data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := s.add(f); err != nil {
+		os.Remove(s.contentPath(f.ID))
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *fileStore) contentPath(id string) string {
+	return filepath.Join(s.contentDir, id)
+}
+
+// content 读取本地文件内容
+func (s *fileStore) content(f *storedFile) ([]byte, error) {
+	if !f.Local {
+		return nil, fmt.Errorf("content of file %s is stored upstream and cannot be downloaded", f.ID)
+	}
+	return os.ReadFile(s.contentPath(f.ID))
+}
+
+func (s *fileStore) get(id, owner string) (*storedFile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[id]
+	if !ok || f.Owner != owner {
+		return nil, false
+	}
+	return f, true
+}
+
+func (s *fileStore) list(owner, purpose string) []FileObject {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []FileObject{}
+	for _, f := range s.files {
+		if f.Owner == owner && (purpose == "" || f.Purpose == purpose) {
+			result = append(result, f.FileObject)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt > result[j].CreatedAt
+	})
+	return result
+}
+
+func (s *fileStore) remove(id, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok || f.Owner != owner {
+		return false, nil
+	}
+	// 保存成功后再删除内容，失败时恢复记录
+	delete(s.files, id)
+	if err := s.save(); err != nil {
+		s.files[id] = f
+		return true, err
+	}
+	if f.Local {
+		os.Remove(s.contentPath(id))
+	}
+	return true, nil
+}
+
+// resolveFileID 将 /v1/files 返回的 file-xxx 转换为上游 fileMetadataId，其他 ID 原样透传
+func resolveFileID(fileID, token string) (string, error) {
+	if !strings.HasPrefix(fileID, "file-") {
+		return fileID, nil
+	}
+	f, ok := files.get(fileID, ownerID(token))
+	if !ok {
+		return "", &AttachmentError{fmt.Sprintf("file %s not found", fileID)}
+	}
+	if f.Local {
+		return "", &AttachmentError{fmt.Sprintf("file %s has purpose %s and cannot be attached", fileID, f.Purpose)}
+	}
+	return f.GrokFileID, nil
+}
+
+var validFilePurposes = map[string]bool{
+	"assistants": true,
+	"vision":     true,
+	"user_data":  true,
+	"batch":      true,
+}
+
+// HandleFiles 上传文件（POST）和列出文件（GET）
+func HandleFiles(w http.ResponseWriter, r *http.Request) {
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(FileListResponse{
+			Object: "list",
+			Data:   files.list(ownerID(token), r.URL.Query().Get("purpose")),
+		})
+	case http.MethodPost:
+		handleFileUpload(w, r, token)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleFileUpload(w http.ResponseWriter, r *http.Request, token string) {
+	maxBytes := int64(0)
+	for _, mb := range GetConfig().UploadLimits {
+		if int64(mb)<<20 > maxBytes {
+			maxBytes = int64(mb) << 20
+		}
+	}
+	if maxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20)
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", fmt.Sprintf("Invalid multipart form: %v", err))
+		return
+	}
+
+	purpose := r.FormValue("purpose")
+	if !validFilePurposes[purpose] {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "",
+			fmt.Sprintf("purpose: must be one of assistants, vision, user_data, batch, got %q", purpose))
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", "file: required")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", fmt.Sprintf("Failed to read file: %v", err))
+		return
+	}
+
+	// 批处理输入只在本地使用，不上传上游
+	if purpose == "batch" {
+		f, err := files.addLocal(ownerID(token), header.Filename, purpose, data)
+		if err != nil {
+			LogError("Failed to save batch input %s: %v", header.Filename, err)
+			writeError(w, http.StatusInternalServerError, "server_error", "", "Failed to save file")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.FileObject)
+		return
+	}
+
+	mimeType, err := detectMimeType(data, header.Header.Get("Content-Type"), header.Filename)
+	if err == nil {
+		err = checkUploadSize(mimeType, len(data))
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+
+	grokFileID, err := uploadFile(header.Filename, mimeType, data, BuildCookie(token))
+	if err != nil {
+		LogError("Failed to upload file %s: %v", header.Filename, err)
+		writeError(w, http.StatusBadGateway, "upstream_error", "", "Failed to upload file to upstream")
+		return
+	}
+
+	f := &storedFile{
+		FileObject: FileObject{
+			ID:        newFileID(),
+			Object:    "file",
+			Bytes:     len(data),
+			CreatedAt: time.Now().Unix(),
+			Filename:  header.Filename,
+			Purpose:   purpose,
+			Status:    "processed",
+		},
+		Owner:      ownerID(token),
+		MimeType:   mimeType,
+		GrokFileID: grokFileID,
+	}
+	if err := files.add(f); err != nil {
+		LogError("Failed to save file store: %v", err)
+		writeError(w, http.StatusInternalServerError, "server_error", "", "Failed to save file record")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.FileObject)
+}
+
+// HandleFile 查询（GET）和删除（DELETE）单个文件
+func HandleFile(w http.ResponseWriter, r *http.Request) {
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+
+	id := r.PathValue("id")
+	owner := ownerID(token)
+
+	switch r.Method {
+	case http.MethodGet:
+		f, ok := files.get(id, owner)
+		if !ok {
+			writeError(w, http.StatusNotFound, "invalid_request_error", "file_not_found", fmt.Sprintf("No such file: %s", id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.FileObject)
+	case http.MethodDelete:
+		// 只删除本地记录，上游文件无删除接口
+		remove := files.remove
+		if batches != nil {
+			remove = batches.removeFile
+		}
+		deleted, err := remove(id, owner)
+		if errors.Is(err, errFileInUse) {
+			writeError(w, http.StatusConflict, "invalid_request_error", "file_in_use",
+				fmt.Sprintf("File %s is the input of a batch that has not finished", id))
+			return
+		}
+		if err != nil {
+			LogError("Failed to save file store: %v", err)
+			writeError(w, http.StatusInternalServerError, "server_error", "", "Failed to delete file")
+			return
+		}
+		if !deleted {
+			writeError(w, http.StatusNotFound, "invalid_request_error", "file_not_found", fmt.Sprintf("No such file: %s", id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(FileDeleteResponse{ID: id, Object: "file", Deleted: true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleFileContent 下载本地保存的文件内容（批处理输入和结果）
+func HandleFileContent(w http.ResponseWriter, r *http.Request) {
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	f, ok := files.get(id, ownerID(token))
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "file_not_found", fmt.Sprintf("No such file: %s", id))
+		return
+	}
+	data, err := files.content(f)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", f.MimeType)
+	w.Write(data)
+}
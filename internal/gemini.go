@@ -0,0 +1,567 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Gemini generateContent 请求与响应
+
+type GeminiPart struct {
+	Text       string            `json:"text,omitempty"`
+	Thought    bool              `json:"thought,omitempty"`
+	InlineData *GeminiInlineData `json:"inlineData,omitempty"`
+	FileData   *GeminiFileData   `json:"fileData,omitempty"`
+}
+
+type GeminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // base64
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"` // user / model
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiThinkingConfig struct {
+	IncludeThoughts bool `json:"includeThoughts"`
+}
+
+type GeminiGenerationConfig struct {
+	StopSequences      []string              `json:"stopSequences,omitempty"`
+	MaxOutputTokens    *int                  `json:"maxOutputTokens,omitempty"`
+	CandidateCount     *int                  `json:"candidateCount,omitempty"`
+	ResponseMimeType   string                `json:"responseMimeType,omitempty"`
+	ResponseSchema     json.RawMessage       `json:"responseSchema,omitempty"`     // OpenAPI 子集，类型名为大写
+	ResponseJSONSchema json.RawMessage       `json:"responseJsonSchema,omitempty"` // 标准 JSON Schema
+	ThinkingConfig     *GeminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type GeminiRequest struct {
+	Contents          []GeminiContent          `json:"contents"`
+	SystemInstruction *GeminiContent           `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig  `json:"generationConfig,omitempty"`
+	Tools             []map[string]interface{} `json:"tools,omitempty"`
+}
+
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate    `json:"candidates"`
+	UsageMetadata *GeminiUsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion  string               `json:"modelVersion"`
+	ResponseID    string               `json:"responseId"`
+}
+
+type GeminiCandidate struct {
+	Content           GeminiContent            `json:"content"`
+	FinishReason      string                   `json:"finishReason,omitempty"`
+	Index             int                      `json:"index"`
+	GroundingMetadata *GeminiGroundingMetadata `json:"groundingMetadata,omitempty"`
+}
+
+type GeminiGroundingMetadata struct {
+	GroundingChunks []GeminiGroundingChunk `json:"groundingChunks"`
+}
+
+type GeminiGroundingChunk struct {
+	Web GeminiWebSource `json:"web"`
+}
+
+type GeminiWebSource struct {
+	URI   string `json:"uri"`
+	Title string `json:"title,omitempty"`
+}
+
+type GeminiUsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// writeGeminiError 返回 Google API 格式的错误
+func writeGeminiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(geminiError(status, message))
+}
+
+func geminiError(status int, message string) map[string]interface{} {
+	statusName := "INTERNAL"
+	switch status {
+	case http.StatusBadRequest:
+		statusName = "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		statusName = "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		statusName = "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		statusName = "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		statusName = "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		statusName = "UNAVAILABLE"
+	}
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"status":  statusName,
+		},
+	}
+}
+
+// geminiToken 依次使用 x-goog-api-key、key 查询参数和 Authorization，均未携带时按 anonymous_use_pool 使用令牌池
+func geminiToken(r *http.Request) string {
+	if key := r.Header.Get("x-goog-api-key"); key != "" {
+		return key
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		return key
+	}
+	return RequestToken(r)
+}
+
+// HandleGemini 处理 /v1beta/models/{model}:generateContent 和 :streamGenerateContent，
+// 不带方法名的 GET 请求返回模型信息
+func HandleGemini(w http.ResponseWriter, r *http.Request) {
+	model, method, _ := strings.Cut(r.PathValue("action"), ":")
+
+	switch {
+	case method == "" && r.Method == http.MethodGet:
+		id, m, ok := LookupModel(model)
+		if !ok {
+			writeGeminiError(w, http.StatusNotFound, fmt.Sprintf("models/%s is not found", model))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(geminiModel(id, m))
+		return
+	case method != "generateContent" && method != "streamGenerateContent":
+		writeGeminiError(w, http.StatusNotFound, fmt.Sprintf("method %q is not supported", method))
+		return
+	case r.Method != http.MethodPost:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var geminiReq GeminiRequest
+	if err := json.NewDecoder(r.Body).Decode(&geminiReq); err != nil {
+		writeGeminiError(w, http.StatusBadRequest, "Invalid JSON payload")
+		return
+	}
+
+	req, err := geminiChatRequest(model, &geminiReq)
+	if err != nil {
+		writeGeminiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token := geminiToken(r)
+	if token == "" {
+		writeGeminiError(w, http.StatusUnauthorized, "API key not provided")
+		return
+	}
+	run, err := startChat(r.Context(), &req, token)
+	if err != nil {
+		writeGeminiError(w, chatErrorStatus(err), err.Error())
+		return
+	}
+	defer run.Close()
+
+	if method == "streamGenerateContent" {
+		streamGemini(w, r, run, model)
+		return
+	}
+
+	results := make([]completion, len(run.Choices))
+	errs := make([]error, len(run.Choices))
+	var wg sync.WaitGroup
+	for i, c := range run.Choices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = completeChoice(c, run.Opts, run.Send)
+		}()
+	}
+	wg.Wait()
+
+	if err := firstChoiceError(errs); err != nil {
+		writeGeminiError(w, chatErrorStatus(err), err.Error())
+		return
+	}
+
+	resp := GeminiResponse{ModelVersion: model, ResponseID: run.Opts.ID}
+	usages := make([]Usage, len(results))
+	for i, c := range results {
+		candidate := GeminiCandidate{Index: i, Content: GeminiContent{Role: "model", Parts: []GeminiPart{}}}
+		if errs[i] != nil {
+			LogWarn("Candidate %d failed: %v", i, errs[i])
+			candidate.FinishReason = "OTHER"
+			resp.Candidates = append(resp.Candidates, candidate)
+			continue
+		}
+		if c.Message.ReasoningContent != "" {
+			candidate.Content.Parts = append(candidate.Content.Parts, GeminiPart{Text: c.Message.ReasoningContent, Thought: true})
+		}
+		if c.Message.Content != "" {
+			candidate.Content.Parts = append(candidate.Content.Parts, GeminiPart{Text: c.Message.Content})
+		}
+		candidate.FinishReason = geminiFinishReason(c.FinishReason)
+		candidate.GroundingMetadata = geminiGrounding(c.Message.Annotations)
+		resp.Candidates = append(resp.Candidates, candidate)
+
+		usages[i] = c.Usage
+	}
+	resp.UsageMetadata = geminiUsage(sumUsage(usages))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// streamGemini 以 SSE（alt=sse）或流式 JSON 数组返回，各候选按 index 区分
+func streamGemini(w http.ResponseWriter, r *http.Request, run *chatRun, model string) {
+	sse := r.URL.Query().Get("alt") == "sse"
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	first := true
+	write := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		switch {
+		case sse:
+			fmt.Fprintf(w, "data: %s\r\n\r\n", data)
+		case first:
+			fmt.Fprintf(w, "[%s", data)
+		default:
+			fmt.Fprintf(w, ",\r\n%s", data)
+		}
+		first = false
+		flusher.Flush()
+	}
+
+	events := make(chan interface{})
+	usages := make([]Usage, len(run.Choices))
+	var wg sync.WaitGroup
+	for i, c := range run.Choices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			usages[i] = streamGeminiCandidate(c, run.Opts, model, events)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	for ev := range events {
+		write(ev)
+	}
+
+	write(GeminiResponse{
+		Candidates:    []GeminiCandidate{},
+		UsageMetadata: geminiUsage(sumUsage(usages)),
+		ModelVersion:  model,
+		ResponseID:    run.Opts.ID,
+	})
+
+	if !sse {
+		fmt.Fprint(w, "]")
+		flusher.Flush()
+	}
+}
+
+// streamGeminiCandidate 转换一路上游对话的输出，返回用量
+func streamGeminiCandidate(c *upstreamChoice, opts responseOptions, model string, out chan<- interface{}) Usage {
+	opts.Cookie = c.Cookie
+
+	send := func(candidate GeminiCandidate) {
+		candidate.Index = c.Index
+		candidate.Content.Role = "model"
+		if candidate.Content.Parts == nil {
+			candidate.Content.Parts = []GeminiPart{}
+		}
+		out <- GeminiResponse{Candidates: []GeminiCandidate{candidate}, ModelVersion: model, ResponseID: opts.ID}
+	}
+
+	if c.Err != nil {
+		LogWarn("Candidate %d failed: %v", c.Index, c.Err)
+		send(GeminiCandidate{FinishReason: "OTHER"})
+		return Usage{}
+	}
+
+	var annotations []Annotation
+	outcome := runChoice(c.Resp.Body, opts, func(ev StreamEvent) {
+		annotations = append(annotations, ev.Annotations...)
+		var parts []GeminiPart
+		if ev.Reasoning != "" {
+			parts = append(parts, GeminiPart{Text: ev.Reasoning, Thought: true})
+		}
+		if ev.Content != "" {
+			parts = append(parts, GeminiPart{Text: ev.Content})
+		}
+		if len(parts) > 0 {
+			send(GeminiCandidate{Content: GeminiContent{Parts: parts}})
+		}
+	})
+
+	if outcome.UpstreamError {
+		err := upstreamFailure(outcome.RateLimited)
+		out <- geminiError(chatErrorStatus(err), err.Error())
+		return Usage{}
+	}
+
+	send(GeminiCandidate{
+		FinishReason:      geminiFinishReason(outcome.FinishReason),
+		GroundingMetadata: geminiGrounding(annotations),
+	})
+
+	// 流式输出无法重试，只在结束时报告校验结果
+	if opts.Structured != nil {
+		if _, err := opts.Structured.validate(outcome.Content); err != nil {
+			LogWarn("Structured output of candidate %d failed validation: %v", c.Index, err)
+			out <- geminiError(http.StatusBadGateway, err.Error())
+		}
+	}
+	return outcome.Usage
+}
+
+// geminiChatRequest 将 Gemini 请求转换为 ChatRequest
+func geminiChatRequest(model string, g *GeminiRequest) (ChatRequest, error) {
+	req := ChatRequest{
+		Model: model,
+		Grok: &GrokOptions{
+			Citations:       CitationAnnotations, // 搜索来源转换为 groundingMetadata
+			ReasoningFormat: ReasoningHidden,
+		},
+	}
+
+	if g.SystemInstruction != nil {
+		var texts []string
+		for _, p := range g.SystemInstruction.Parts {
+			if p.Text != "" {
+				texts = append(texts, p.Text)
+			}
+		}
+		if len(texts) > 0 {
+			req.Messages = append(req.Messages, Message{Role: "system", Content: strings.Join(texts, "\n")})
+		}
+	}
+
+	for i, content := range g.Contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		var parts []interface{}
+		for _, p := range content.Parts {
+			switch {
+			case p.Thought:
+				// 历史中的思考内容不回传上游
+			case p.InlineData != nil:
+				url := fmt.Sprintf("data:%s;base64,%s", p.InlineData.MimeType, p.InlineData.Data)
+				parts = append(parts, geminiAttachmentPart(p.InlineData.MimeType, url))
+			case p.FileData != nil:
+				if !strings.HasPrefix(p.FileData.FileURI, "http://") && !strings.HasPrefix(p.FileData.FileURI, "https://") {
+					return req, fmt.Errorf("contents[%d]: fileData.fileUri must be an http(s) URL", i)
+				}
+				if p.FileData.MimeType != "" && !strings.HasPrefix(p.FileData.MimeType, "image/") {
+					return req, fmt.Errorf("contents[%d]: fileData only supports images, got %s", i, p.FileData.MimeType)
+				}
+				parts = append(parts, geminiAttachmentPart("image/", p.FileData.FileURI))
+			case p.Text != "":
+				parts = append(parts, map[string]interface{}{"type": "text", "text": p.Text})
+			}
+		}
+		req.Messages = append(req.Messages, Message{Role: role, Content: parts})
+	}
+
+	for _, tool := range g.Tools {
+		_, search := tool["googleSearch"]
+		_, retrieval := tool["googleSearchRetrieval"]
+		if search || retrieval {
+			req.Grok.Search = boolPtr(true)
+		}
+	}
+
+	cfg := g.GenerationConfig
+	if cfg == nil {
+		return req, nil
+	}
+	if len(cfg.StopSequences) > 0 {
+		stops := make([]interface{}, len(cfg.StopSequences))
+		for i, s := range cfg.StopSequences {
+			stops[i] = s
+		}
+		req.Stop = stops
+	}
+	req.MaxTokens = cfg.MaxOutputTokens
+	req.N = cfg.CandidateCount
+	if cfg.ThinkingConfig != nil && cfg.ThinkingConfig.IncludeThoughts {
+		req.Grok.ReasoningFormat = ReasoningContentField
+	}
+
+	switch cfg.ResponseMimeType {
+	case "", "text/plain":
+	case "application/json":
+		req.ResponseFormat = &ResponseFormat{Type: ResponseFormatJSONObject}
+		schema := cfg.ResponseJSONSchema
+		if len(schema) == 0 && len(cfg.ResponseSchema) > 0 {
+			var err error
+			if schema, err = geminiSchema(cfg.ResponseSchema); err != nil {
+				return req, fmt.Errorf("generationConfig.responseSchema: %v", err)
+			}
+		}
+		if len(schema) > 0 {
+			req.ResponseFormat = &ResponseFormat{
+				Type:       ResponseFormatJSONSchema,
+				JSONSchema: &JSONSchemaFormat{Name: "response", Schema: schema},
+			}
+		}
+	default:
+		return req, fmt.Errorf("generationConfig.responseMimeType: unsupported value %q", cfg.ResponseMimeType)
+	}
+	return req, nil
+}
+
+func geminiAttachmentPart(mimeType, url string) map[string]interface{} {
+	if strings.HasPrefix(mimeType, "image/") {
+		return map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]interface{}{"url": url},
+		}
+	}
+	return map[string]interface{}{
+		"type": "file",
+		"file": map[string]interface{}{"file_data": url},
+	}
+}
+
+// geminiSchema 将 Gemini 的 OpenAPI 风格 schema（大写类型名、nullable）转换为 JSON Schema
+func geminiSchema(raw json.RawMessage) (json.RawMessage, error) {
+	var schema interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+	return json.Marshal(convertGeminiSchema(schema))
+}
+
+func convertGeminiSchema(node interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			switch key {
+			case "type":
+				if t, ok := val.(string); ok {
+					out[key] = strings.ToLower(t)
+					continue
+				}
+			case "nullable", "propertyOrdering":
+				continue
+			}
+			out[key] = convertGeminiSchema(val)
+		}
+		if nullable, _ := v["nullable"].(bool); nullable {
+			if t, ok := out["type"].(string); ok {
+				out["type"] = []interface{}{t, "null"}
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = convertGeminiSchema(item)
+		}
+		return out
+	}
+	return node
+}
+
+func geminiFinishReason(reason string) string {
+	if reason == "length" {
+		return "MAX_TOKENS"
+	}
+	return "STOP"
+}
+
+// geminiGrounding 将 url_citation 注解转换为 groundingMetadata
+func geminiGrounding(annotations []Annotation) *GeminiGroundingMetadata {
+	var chunks []GeminiGroundingChunk
+	seen := make(map[string]bool)
+	for _, a := range annotations {
+		if a.URLCitation == nil || seen[a.URLCitation.URL] {
+			continue
+		}
+		seen[a.URLCitation.URL] = true
+		chunks = append(chunks, GeminiGroundingChunk{Web: GeminiWebSource{URI: a.URLCitation.URL, Title: a.URLCitation.Title}})
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	return &GeminiGroundingMetadata{GroundingChunks: chunks}
+}
+
+func geminiUsage(u Usage) *GeminiUsageMetadata {
+	return &GeminiUsageMetadata{
+		PromptTokenCount:     u.PromptTokens,
+		CandidatesTokenCount: u.CompletionTokens,
+		TotalTokenCount:      u.TotalTokens,
+	}
+}
+
+func geminiModel(id string, m ModelConfig) map[string]interface{} {
+	info := newModelInfo(id, m)
+	name := info.Name
+	if name == "" {
+		name = id
+	}
+	return map[string]interface{}{
+		"name":                       "models/" + id,
+		"displayName":                name,
+		"description":                info.Description,
+		"supportedGenerationMethods": []string{"generateContent", "streamGenerateContent"},
+	}
+}
+
+// HandleGeminiModels 兼容 Gemini GET /v1beta/models
+func HandleGeminiModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	catalog := ModelCatalog()
+	ids := make([]string, 0, len(catalog))
+	for id := range catalog {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	models := []map[string]interface{}{}
+	for _, id := range ids {
+		models = append(models, geminiModel(id, catalog[id]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
+}
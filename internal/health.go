@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+type CheckResult struct {
+	OK          bool   `json:"ok"`
+	Enabled     *bool  `json:"enabled,omitempty"`
+	Error       string `json:"error,omitempty"`
+	LastSuccess string `json:"last_success,omitempty"`
+	LastAttempt string `json:"last_attempt,omitempty"`
+}
+
+type ReadyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// 上游探活状态
+var probeState struct {
+	sync.RWMutex
+	lastAttempt time.Time
+	lastSuccess time.Time
+	lastError   string
+}
+
+// HandleHealthz 进程存活检查
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleReadyz 就绪检查：配置、TLS 客户端以及（可选的）上游探活
+func HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]CheckResult{}
+	ready := true
+
+	if GetConfig() != nil {
+		checks["config"] = CheckResult{OK: true}
+	} else {
+		checks["config"] = CheckResult{OK: false, Error: "config not loaded"}
+		ready = false
+	}
+
+	if GetHTTPClient() != nil {
+		checks["tls_client"] = CheckResult{OK: true}
+	} else {
+		checks["tls_client"] = CheckResult{OK: false, Error: "failed to create TLS client"}
+		ready = false
+	}
+
+	upstream := upstreamCheck()
+	checks["upstream"] = upstream
+	if !upstream.OK {
+		ready = false
+	}
+
+	resp := ReadyResponse{Status: "ready", Checks: checks}
+	status := http.StatusOK
+	if !ready {
+		resp.Status = "not_ready"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func upstreamCheck() CheckResult {
+	cfg := GetConfig()
+	enabled := cfg != nil && cfg.ProbeInterval > 0 && len(cfg.Tokens) > 0
+	if !enabled {
+		return CheckResult{OK: true, Enabled: &enabled}
+	}
+
+	probeState.RLock()
+	defer probeState.RUnlock()
+
+	result := CheckResult{Enabled: &enabled, Error: probeState.lastError}
+	if !probeState.lastAttempt.IsZero() {
+		result.LastAttempt = probeState.lastAttempt.Format(time.RFC3339)
+	}
+	if !probeState.lastSuccess.IsZero() {
+		result.LastSuccess = probeState.lastSuccess.Format(time.RFC3339)
+	}
+
+	// 最近三个探活周期内成功过即视为正常
+	maxAge := 3 * time.Duration(cfg.ProbeInterval) * time.Second
+	result.OK = !probeState.lastSuccess.IsZero() && time.Since(probeState.lastSuccess) <= maxAge
+	if !result.OK && result.Error == "" {
+		result.Error = "no successful probe yet"
+	}
+	return result
+}
+
+// StartUpstreamProbe 周期性使用令牌池中的令牌探测 grok.com，间隔随配置热重载生效
+func StartUpstreamProbe() {
+	go func() {
+		for {
+			cfg := GetConfig()
+			if cfg.ProbeInterval <= 0 || len(cfg.Tokens) == 0 {
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			err := probeUpstream(NextPoolToken())
+
+			probeState.Lock()
+			probeState.lastAttempt = time.Now()
+			if err != nil {
+				probeState.lastError = err.Error()
+				LogWarn("Upstream probe failed: %v", err)
+			} else {
+				probeState.lastError = ""
+				probeState.lastSuccess = probeState.lastAttempt
+				LogDebug("Upstream probe succeeded")
+			}
+			probeState.Unlock()
+
+			time.Sleep(time.Duration(cfg.ProbeInterval) * time.Second)
+		}
+	}()
+}
+
+// 查询限额接口作为轻量级探活请求
+func probeUpstream(token string) error {
+	body, _ := json.Marshal(map[string]string{
+		"requestKind": "DEFAULT",
+		"modelName":   "grok-3",
+	})
+
+	req, err := fhttp.NewRequest("POST", BaseURL+"/rest/rate-limits", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	SetChatHeaders(req, BuildCookie(token))
+
+	client := GetHTTPClient()
+	if client == nil {
+		return fmt.Errorf("failed to create TLS client")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("probe failed: status %d", resp.StatusCode)
+	}
+	return nil
+}
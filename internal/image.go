@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// 解码前的像素上限，防止解压炸弹
+const maxImagePixels = 100_000_000
+
+// ImageProcessingConfig 上传前的图片预处理配置
+type ImageProcessingConfig struct {
+	Enabled            bool   `yaml:"enabled" json:"enabled"`
+	MaxDimension       int    `yaml:"max_dimension" json:"max_dimension"`               // 长边上限（像素）
+	LowDetailDimension int    `yaml:"low_detail_dimension" json:"low_detail_dimension"` // detail=low 时的长边上限
+	Format             string `yaml:"format" json:"format"`                             // auto / jpeg / png
+	JPEGQuality        int    `yaml:"jpeg_quality" json:"jpeg_quality"`
+	MaxInputMB         int    `yaml:"max_input_mb" json:"max_input_mb"` // 预处理前原始图片的大小上限，upload_limits_mb.image 改为检查预处理后的结果
+}
+
+// preprocessImage 解码图片，按 EXIF 方向校正并缩放到 maxDim 以内，重新编码后去除 EXIF 等元数据
+func preprocessImage(data []byte, maxDim int) ([]byte, string, error) {
+	cfg := GetConfig().ImageProcessing
+
+	imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &AttachmentError{fmt.Sprintf("cannot decode image: %v", err)}
+	}
+	if imgCfg.Width*imgCfg.Height > maxImagePixels {
+		return nil, "", &AttachmentError{fmt.Sprintf("image is %dx%d pixels, exceeds limit of %d pixels", imgCfg.Width, imgCfg.Height, maxImagePixels)}
+	}
+
+	img, srcFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &AttachmentError{fmt.Sprintf("cannot decode image: %v", err)}
+	}
+
+	if srcFormat == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	if b := img.Bounds(); maxDim > 0 && (b.Dx() > maxDim || b.Dy() > maxDim) {
+		w, h := b.Dx(), b.Dy()
+		if w >= h {
+			h, w = h*maxDim/w, maxDim
+		} else {
+			w, h = w*maxDim/h, maxDim
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, max(w, 1), max(h, 1)))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+		img = dst
+	}
+
+	format := cfg.Format
+	if format == "auto" {
+		format = "jpeg"
+		if !isOpaque(img) {
+			format = "png"
+		}
+	}
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, flattenAlpha(img), &jpeg.Options{Quality: cfg.JPEGQuality})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), "image/" + format, nil
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// JPEG 不支持透明通道，透明区域以白色填充
+func flattenAlpha(img image.Image) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+// jpegOrientation 读取 JPEG APP1 段中的 EXIF Orientation，未找到时返回 1
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if marker == 0xDA || size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) > 14 && string(seg[:6]) == "Exif\x00\x00" {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8 : entry+10])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation 按 EXIF Orientation 旋转或翻转图片
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	swap := orientation >= 5
+	dw, dh := w, h
+	if swap {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// isHEIC 判断是否为 HEIC/HEIF/AVIF 图片（ISO BMFF ftyp 品牌），纯 Go 无法解码
+func isHEIC(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(data[8:12]) {
+	case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1", "avif":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,481 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 异步任务状态
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// 回调投递状态
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// ChatJobRequest 提交异步对话任务，request 与 /v1/chat/completions 的请求体相同
+type ChatJobRequest struct {
+	Request    ChatRequest       `json:"request"`
+	WebhookURL string            `json:"webhook_url,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// ChatJob 异步对话任务，运行中通过 partial 返回已生成的内容
+type ChatJob struct {
+	ID          string                  `json:"id"`
+	Object      string                  `json:"object"`
+	Model       string                  `json:"model"`
+	Status      string                  `json:"status"`
+	CreatedAt   int64                   `json:"created_at"`
+	StartedAt   *int64                  `json:"started_at"`
+	CompletedAt *int64                  `json:"completed_at"`
+	Partial     []JobPartialChoice      `json:"partial,omitempty"`
+	Result      *ChatCompletionResponse `json:"result"`
+	Error       *ErrorDetail            `json:"error"`
+	Webhook     *JobWebhook             `json:"webhook,omitempty"`
+	Metadata    map[string]string       `json:"metadata,omitempty"`
+}
+
+type JobPartialChoice struct {
+	Index            int    `json:"index"`
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+}
+
+type JobWebhook struct {
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	DeliveredAt *int64 `json:"delivered_at,omitempty"`
+}
+
+// chatJob 内存中的任务，partial 按候选下标累积输出
+type chatJob struct {
+	ChatJob
+	owner   string
+	cancel  context.CancelFunc
+	partial map[int]*jobPartial
+}
+
+type jobPartial struct {
+	content   strings.Builder
+	reasoning strings.Builder
+}
+
+// jobStore 异步任务只保存在内存中，结束 job_retention 秒后清除
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*chatJob
+}
+
+var jobs = &jobStore{jobs: make(map[string]*chatJob)}
+
+// snapshot 返回任务对象的副本，调用方需持有锁
+func (j *chatJob) snapshot() ChatJob {
+	job := j.ChatJob
+	if j.Status == JobRunning && len(j.partial) > 0 {
+		job.Partial = make([]JobPartialChoice, 0, len(j.partial))
+		for i := 0; len(job.Partial) < len(j.partial); i++ {
+			if p, ok := j.partial[i]; ok {
+				job.Partial = append(job.Partial, JobPartialChoice{
+					Index:            i,
+					Content:          p.content.String(),
+					ReasoningContent: p.reasoning.String(),
+				})
+			}
+		}
+	}
+	if j.Webhook != nil {
+		webhook := *j.Webhook
+		job.Webhook = &webhook
+	}
+	return job
+}
+
+func (s *jobStore) get(id, owner string) (ChatJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	j, ok := s.jobs[id]
+	if !ok || j.owner != owner {
+		return ChatJob{}, false
+	}
+	return j.snapshot(), true
+}
+
+// prune 清除过期的已结束任务，调用方需持有锁
+func (s *jobStore) prune() {
+	cutoff := time.Now().Add(-time.Duration(GetConfig().JobRetention) * time.Second).Unix()
+	for id, j := range s.jobs {
+		if j.CompletedAt != nil && *j.CompletedAt < cutoff &&
+			(j.Webhook == nil || j.Webhook.Status != WebhookPending) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *jobStore) submit(req ChatJobRequest, owner, token string) ChatJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &chatJob{
+		ChatJob: ChatJob{
+			ID:        "job_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Object:    "chat.job",
+			Model:     req.Request.Model,
+			Status:    JobQueued,
+			CreatedAt: time.Now().Unix(),
+			Metadata:  req.Metadata,
+		},
+		owner:   owner,
+		cancel:  cancel,
+		partial: make(map[int]*jobPartial),
+	}
+	if req.WebhookURL != "" {
+		j.Webhook = &JobWebhook{URL: req.WebhookURL, Status: WebhookPending}
+	}
+
+	s.mu.Lock()
+	s.prune()
+	s.jobs[j.ID] = j
+	job := j.snapshot()
+	s.mu.Unlock()
+
+	chatReq := req.Request
+	chatReq.Stream = false
+	go s.run(ctx, j, &chatReq, token)
+	return job
+}
+
+func (s *jobStore) cancelJob(id, owner string) (ChatJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.owner != owner {
+		return ChatJob{}, errJobNotFound
+	}
+	if j.Status != JobQueued && j.Status != JobRunning {
+		return ChatJob{}, fmt.Errorf("cannot cancel a job with status %s", j.Status)
+	}
+	j.cancel()
+	return j.snapshot(), nil
+}
+
+var errJobNotFound = errors.New("job not found")
+
+func (s *jobStore) update(j *chatJob, fn func(j *chatJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(j)
+}
+
+func (s *jobStore) run(ctx context.Context, j *chatJob, req *ChatRequest, token string) {
+	defer j.cancel()
+	s.update(j, func(j *chatJob) {
+		j.Status = JobRunning
+		j.StartedAt = unixNow()
+	})
+
+	result, err := s.execute(ctx, j, req, token)
+
+	var payload interface{}
+	s.update(j, func(j *chatJob) {
+		j.CompletedAt = unixNow()
+		j.partial = nil
+		switch {
+		case ctx.Err() != nil:
+			j.Status = JobCancelled
+		case err != nil:
+			j.Status = JobFailed
+			j.Error = jobError(err)
+			payload = ErrorResponse{Error: *j.Error}
+		default:
+			j.Status = JobSucceeded
+			j.Result = result
+			payload = result
+		}
+	})
+	LogInfo("Job %s %s", j.ID, j.Status)
+
+	if j.Webhook != nil {
+		if payload == nil {
+			s.update(j, func(j *chatJob) {
+				j.Webhook.Status = WebhookFailed
+				j.Webhook.LastError = "job was cancelled"
+			})
+			return
+		}
+		s.deliver(j, payload)
+	}
+}
+
+// execute 与非流式 /v1/chat/completions 相同，但输出逐段记录到任务中供查询
+func (s *jobStore) execute(ctx context.Context, j *chatJob, req *ChatRequest, token string) (*ChatCompletionResponse, error) {
+	run, err := startChat(ctx, req, token)
+	if err != nil {
+		return nil, err
+	}
+	defer run.Close()
+
+	results := make([]completion, len(run.Choices))
+	errs := make([]error, len(run.Choices))
+	var wg sync.WaitGroup
+	for i, c := range run.Choices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			opts := run.Opts
+			opts.Progress = func(ev StreamEvent) {
+				s.update(j, func(j *chatJob) {
+					if j.partial == nil {
+						return
+					}
+					p, ok := j.partial[c.Index]
+					if !ok {
+						p = &jobPartial{}
+						j.partial[c.Index] = p
+					}
+					p.content.WriteString(ev.Content)
+					p.reasoning.WriteString(ev.Reasoning)
+				})
+			}
+			results[i], errs[i] = completeChoice(c, opts, run.Send)
+		}()
+	}
+	wg.Wait()
+
+	if err := firstChoiceError(errs); err != nil {
+		return nil, err
+	}
+	resp := buildChatResponse(run.Opts, results, errs)
+	return &resp, nil
+}
+
+// jobError 将 startChat 或候选的错误转换为 OpenAI 错误对象
+func jobError(err error) *ErrorDetail {
+	detail := &ErrorDetail{Message: err.Error(), Type: "upstream_error"}
+	var reqErr *requestError
+	var validationErr *outputValidationError
+	switch status := chatErrorStatus(err); {
+	case errors.As(err, &reqErr):
+		detail.Type = "invalid_request_error"
+		if reqErr.Code != "" {
+			detail.Code = stringPtr(reqErr.Code)
+		}
+	case status == http.StatusTooManyRequests:
+		detail.Type = "rate_limit_error"
+	case errors.As(err, &validationErr):
+		detail.Type = "invalid_response_error"
+		detail.Code = stringPtr("json_validation_failed")
+	}
+	return detail
+}
+
+// deliver 投递回调，非 2xx 或网络错误时按 1s、2s、4s… 重试
+func (s *jobStore) deliver(j *chatJob, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		LogError("Failed to encode webhook payload of job %s: %v", j.ID, err)
+		return
+	}
+
+	maxRetries := GetConfig().WebhookMaxRetries
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(j.Webhook.URL, j.ID, j.Status, body)
+		s.update(j, func(j *chatJob) {
+			j.Webhook.Attempts++
+			if err == nil {
+				j.Webhook.Status = WebhookDelivered
+				j.Webhook.DeliveredAt = unixNow()
+				j.Webhook.LastError = ""
+			} else {
+				j.Webhook.LastError = err.Error()
+				if attempt >= maxRetries {
+					j.Webhook.Status = WebhookFailed
+				}
+			}
+		})
+		if err == nil {
+			LogInfo("Delivered webhook of job %s", j.ID)
+			return
+		}
+		if attempt >= maxRetries {
+			LogError("Giving up webhook of job %s after %d attempts: %v", j.ID, attempt+1, err)
+			return
+		}
+
+		delay := time.Duration(1<<attempt) * time.Second
+		LogWarn("Webhook of job %s failed, retrying in %s: %v", j.ID, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// signWebhook 计算 HMAC-SHA256(secret, "<timestamp>.<body>")
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(target, jobID, status string, body []byte) error {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-ID", jobID)
+	req.Header.Set("X-Job-Status", status)
+	req.Header.Set("X-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, signWebhook(GetConfig().WebhookSecret, timestamp, body)))
+
+	resp, err := newWebhookClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newWebhookClient 与远程图片下载相同，默认拦截内网地址；不跟随重定向
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !GetConfig().FetchAllowPrivate {
+		dialer.Control = ssrfControl
+	}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func validateWebhookURL(raw string) error {
+	if GetConfig().WebhookSecret == "" {
+		return errors.New("webhook_url: webhooks are disabled, webhook_secret is not configured")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook_url: must be an absolute http(s) URL, got %q", raw)
+	}
+	return nil
+}
+
+// HandleJobs 提交异步对话任务，立即返回任务 ID
+func HandleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// 任务按令牌区分所有者，匿名调用方无法互相隔离
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+
+	var req ChatJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Request.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", "request.messages: required")
+		return
+	}
+	if req.WebhookURL != "" {
+		if err := validateWebhookURL(req.WebhookURL); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+	}
+
+	job := jobs.submit(req, ownerID(token), token)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// HandleJob 查询任务状态、部分输出和最终结果
+func HandleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+
+	id := r.PathValue("id")
+	job, ok := jobs.get(id, ownerID(token))
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "job_not_found", fmt.Sprintf("No such job: %s", id))
+		return
+	}
+	if job.Status == JobQueued || job.Status == JobRunning {
+		w.Header().Set("Retry-After", "2")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// HandleJobCancel 取消运行中的任务
+func HandleJobCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+
+	id := r.PathValue("id")
+	job, err := jobs.cancelJob(id, ownerID(token))
+	if errors.Is(err, errJobNotFound) {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "job_not_found", fmt.Sprintf("No such job: %s", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, "invalid_request_error", "", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,434 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaValidator 校验 JSON Schema 的常用子集：
+// type、enum、const、properties、required、additionalProperties、items、
+// 长度/数量/数值范围、pattern、allOf/anyOf/oneOf 以及本文档内的 $ref
+type schemaValidator struct {
+	root     interface{}
+	steps    int                       // 已执行的 validate 次数，超过 maxSchemaSteps 后全部失败
+	patterns map[string]*regexp.Regexp // 已编译的 pattern，无效的 pattern 为 nil
+}
+
+// validateJSONSchema 校验已解码的 JSON 值，返回第一个不符合的位置
+func validateJSONSchema(schema, value interface{}) error {
+	v := &schemaValidator{root: schema, patterns: make(map[string]*regexp.Regexp)}
+	err := v.validate(schema, value, "$", 0)
+	// anyOf/oneOf 会吞掉分支的错误，超出步数时统一报告
+	if v.steps > maxSchemaSteps {
+		return fmt.Errorf("$: schema validation exceeded %d steps", maxSchemaSteps)
+	}
+	return err
+}
+
+const (
+	maxSchemaDepth = 64
+	maxSchemaSteps = 10000 // anyOf/oneOf 分支的组合可能呈指数增长
+)
+
+func (v *schemaValidator) validate(schema, value interface{}, path string, depth int) error {
+	if v.steps++; v.steps > maxSchemaSteps {
+		return fmt.Errorf("%s: schema validation exceeded %d steps", path, maxSchemaSteps)
+	}
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("%s: schema nesting too deep", path)
+	}
+
+	var s map[string]interface{}
+	switch sv := schema.(type) {
+	case bool:
+		if !sv {
+			return fmt.Errorf("%s: value is not allowed", path)
+		}
+		return nil
+	case map[string]interface{}:
+		s = sv
+	default:
+		return nil
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := v.resolveRef(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := v.validate(target, value, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, describeType(t), jsonTypeName(value))
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, value) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := v.validate(sub, value, path, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		var firstErr error
+		matched := false
+		for _, sub := range anyOf {
+			err := v.validate(sub, value, path, depth+1)
+			if err == nil {
+				matched = true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value does not match any schema in anyOf (%v)", path, firstErr)
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if v.validate(sub, value, path, depth+1) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: value matches %d schemas in oneOf, expected exactly 1", path, matches)
+		}
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		return v.validateObject(s, val, path, depth)
+	case []interface{}:
+		return v.validateArray(s, val, path, depth)
+	case string:
+		return v.validateString(s, val, path)
+	case float64:
+		return validateNumber(s, val, path)
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(s map[string]interface{}, obj map[string]interface{}, path string, depth int) error {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, exists := obj[name]; !exists {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+
+	// 按属性名排序，保证报告的错误位置稳定
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	props, _ := s["properties"].(map[string]interface{})
+	for _, name := range names {
+		val := obj[name]
+		childPath := path + "." + name
+		if sub, ok := props[name]; ok {
+			if err := v.validate(sub, val, childPath, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if additional, ok := s["additionalProperties"]; ok {
+			if b, isBool := additional.(bool); isBool && !b {
+				return fmt.Errorf("%s: additional property %q is not allowed", path, name)
+			}
+			if err := v.validate(additional, val, childPath, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n, ok := schemaInt(s, "minProperties"); ok && len(obj) < n {
+		return fmt.Errorf("%s: expected at least %d properties, got %d", path, n, len(obj))
+	}
+	if n, ok := schemaInt(s, "maxProperties"); ok && len(obj) > n {
+		return fmt.Errorf("%s: expected at most %d properties, got %d", path, n, len(obj))
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateArray(s map[string]interface{}, arr []interface{}, path string, depth int) error {
+	if n, ok := schemaInt(s, "minItems"); ok && len(arr) < n {
+		return fmt.Errorf("%s: expected at least %d items, got %d", path, n, len(arr))
+	}
+	if n, ok := schemaInt(s, "maxItems"); ok && len(arr) > n {
+		return fmt.Errorf("%s: expected at most %d items, got %d", path, n, len(arr))
+	}
+	if items, ok := s["items"]; ok {
+		for i, item := range arr {
+			if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if unique, _ := s["uniqueItems"].(bool); unique {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if jsonEqual(arr[i], arr[j]) {
+					return fmt.Errorf("%s: items %d and %d are not unique", path, i, j)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateString(s map[string]interface{}, str, path string) error {
+	length := utf8.RuneCountInString(str)
+	if n, ok := schemaInt(s, "minLength"); ok && length < n {
+		return fmt.Errorf("%s: expected at least %d characters, got %d", path, n, length)
+	}
+	if n, ok := schemaInt(s, "maxLength"); ok && length > n {
+		return fmt.Errorf("%s: expected at most %d characters, got %d", path, n, length)
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		re, ok := v.patterns[pattern]
+		if !ok {
+			re, _ = regexp.Compile(pattern)
+			v.patterns[pattern] = re
+		}
+		if re == nil {
+			return fmt.Errorf("%s: invalid pattern %q in schema", path, pattern)
+		}
+		if !re.MatchString(str) {
+			return fmt.Errorf("%s: value does not match pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(s map[string]interface{}, num float64, path string) error {
+	if min, ok := s["minimum"].(float64); ok && num < min {
+		return fmt.Errorf("%s: %v is less than minimum %v", path, num, min)
+	}
+	if max, ok := s["maximum"].(float64); ok && num > max {
+		return fmt.Errorf("%s: %v is greater than maximum %v", path, num, max)
+	}
+	if min, ok := s["exclusiveMinimum"].(float64); ok && num <= min {
+		return fmt.Errorf("%s: %v must be greater than %v", path, num, min)
+	}
+	if max, ok := s["exclusiveMaximum"].(float64); ok && num >= max {
+		return fmt.Errorf("%s: %v must be less than %v", path, num, max)
+	}
+	if m, ok := s["multipleOf"].(float64); ok && m > 0 {
+		if q := num / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			return fmt.Errorf("%s: %v is not a multiple of %v", path, num, m)
+		}
+	}
+	return nil
+}
+
+// resolveRef 解析文档内引用，如 #/$defs/Item、#/definitions/Item
+func (v *schemaValidator) resolveRef(ref string) (interface{}, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q, only local references are supported", ref)
+	}
+	node := v.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot resolve $ref %q", ref)
+		}
+		if node, ok = m[token]; !ok {
+			return nil, fmt.Errorf("cannot resolve $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// checkSchemaRefs 拒绝不经过 properties/items 等嵌套就回到自身的 $ref 循环，
+// 如 {"oneOf":[{"$ref":"#"}]}，这类 schema 在同一个值上无限展开
+func checkSchemaRefs(root interface{}) error {
+	v := &schemaValidator{root: root}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[uintptr]int)
+
+	// 只沿与当前值在同一位置校验的子 schema（$ref、allOf、anyOf、oneOf）查找环
+	var visit func(node interface{}) error
+	visit = func(node interface{}) error {
+		s, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		id := reflect.ValueOf(s).Pointer()
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("$ref cycle that does not nest into properties or items")
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		for _, sub := range v.inPlaceSchemas(s) {
+			if err := visit(sub); err != nil {
+				return err
+			}
+		}
+		state[id] = done
+		return nil
+	}
+
+	// 每个子 schema 都作为起点检查一次
+	seen := make(map[uintptr]bool)
+	var walk func(node interface{}) error
+	walk = func(node interface{}) error {
+		s, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		id := reflect.ValueOf(s).Pointer()
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+		if err := visit(s); err != nil {
+			return err
+		}
+		for _, sub := range append(v.inPlaceSchemas(s), nestedSchemas(s)...) {
+			if err := walk(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// inPlaceSchemas 与当前值在同一位置校验的子 schema，无法解析的 $ref 留给校验时报告
+func (v *schemaValidator) inPlaceSchemas(s map[string]interface{}) []interface{} {
+	var subs []interface{}
+	if ref, ok := s["$ref"].(string); ok {
+		if target, err := v.resolveRef(ref); err == nil {
+			subs = append(subs, target)
+		}
+	}
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		if list, ok := s[key].([]interface{}); ok {
+			subs = append(subs, list...)
+		}
+	}
+	return subs
+}
+
+// nestedSchemas 校验属性、数组元素时使用的子 schema 以及 $defs 中的定义
+func nestedSchemas(s map[string]interface{}) []interface{} {
+	var subs []interface{}
+	for _, key := range []string{"properties", "$defs", "definitions"} {
+		if m, ok := s[key].(map[string]interface{}); ok {
+			for _, sub := range m {
+				subs = append(subs, sub)
+			}
+		}
+	}
+	for _, key := range []string{"items", "additionalProperties"} {
+		if sub, ok := s[key]; ok {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+func schemaInt(s map[string]interface{}, key string) (int, bool) {
+	f, ok := s[key].(float64)
+	return int(f), ok
+}
+
+func matchesType(t, value interface{}) bool {
+	switch tv := t.(type) {
+	case string:
+		return matchesTypeName(tv, value)
+	case []interface{}:
+		for _, name := range tv {
+			if s, ok := name.(string); ok && matchesTypeName(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonTypeName(value) == name
+	}
+}
+
+func describeType(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		var names []string
+		for _, n := range list {
+			names = append(names, fmt.Sprint(n))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
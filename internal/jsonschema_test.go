@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+func mustDecodeJSON(t *testing.T, raw string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		t.Fatalf("decode %s: %v", raw, err)
+	}
+	return v
+}
+
+func TestValidateJSONSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		value   string
+		wantErr string
+	}{
+		{"type ok", `{"type":"object"}`, `{}`, ""},
+		{"type mismatch", `{"type":"object"}`, `[]`, "$: expected object, got array"},
+		{"type list", `{"type":["string","null"]}`, `null`, ""},
+		{"integer", `{"type":"integer"}`, `1.5`, "expected integer, got number"},
+		{"required", `{"type":"object","required":["a"]}`, `{"b":1}`, `missing required property "a"`},
+		{"nested property", `{"properties":{"a":{"properties":{"b":{"type":"string"}}}}}`, `{"a":{"b":1}}`, "$.a.b: expected string"},
+		{"additional false", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, `additional property "b" is not allowed`},
+		{"additional schema", `{"additionalProperties":{"type":"number"}}`, `{"x":"y"}`, "$.x: expected number"},
+		{"enum", `{"enum":["a","b"]}`, `"c"`, "not one of the allowed enum values"},
+		{"const", `{"const":{"k":1}}`, `{"k":1}`, ""},
+		{"items", `{"items":{"type":"integer"}}`, `[1,2,"x"]`, "$[2]: expected integer"},
+		{"min items", `{"minItems":2}`, `[1]`, "expected at least 2 items"},
+		{"unique items", `{"uniqueItems":true}`, `[1,{"a":1},{"a":1}]`, "items 1 and 2 are not unique"},
+		{"max length counts runes", `{"maxLength":2}`, `"你好"`, ""},
+		{"min length", `{"minLength":3}`, `"ab"`, "expected at least 3 characters"},
+		{"pattern", `{"pattern":"^[a-z]+$"}`, `"abc1"`, "does not match pattern"},
+		{"invalid pattern", `{"pattern":"("}`, `"a"`, "invalid pattern"},
+		{"minimum", `{"minimum":1}`, `0`, "less than minimum"},
+		{"exclusive maximum", `{"exclusiveMaximum":1}`, `1`, "must be less than 1"},
+		{"multiple of", `{"multipleOf":0.1}`, `0.3`, ""},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"number"}]}`, `true`, "does not match any schema in anyOf"},
+		{"oneOf exactly one", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1.5`, ""},
+		{"oneOf two matches", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, "matches 2 schemas in oneOf"},
+		{"allOf", `{"allOf":[{"required":["a"]},{"required":["b"]}]}`, `{"a":1}`, `missing required property "b"`},
+		{"false schema", `{"properties":{"a":false}}`, `{"a":1}`, "$.a: value is not allowed"},
+		{"defs ref", `{"$defs":{"n":{"type":"number"}},"properties":{"a":{"$ref":"#/$defs/n"}}}`, `{"a":"x"}`, "$.a: expected number"},
+		{"recursive ref", `{"properties":{"child":{"$ref":"#"}},"required":["id"]}`, `{"id":1,"child":{"id":2,"child":{}}}`, `$.child.child: missing required property "id"`},
+		{"unresolvable ref", `{"$ref":"#/$defs/missing"}`, `1`, `cannot resolve $ref`},
+		{"remote ref", `{"$ref":"https://example.com/s.json"}`, `1`, "only local references are supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateJSONSchema(mustDecodeJSON(t, tt.schema), mustDecodeJSON(t, tt.value))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateJSONSchema(%s, %s) = %v, want nil", tt.schema, tt.value, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateJSONSchema(%s, %s) = %v, want error containing %q", tt.schema, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJSONSchemaStepBudget(t *testing.T) {
+	// 每一层都有两个分支，没有步数上限时需要约 2^40 次校验
+	schema := mustDecodeJSON(t, `{"properties":{"a":{"oneOf":[{"$ref":"#"},{"$ref":"#"}]}}}`)
+	value := interface{}(map[string]interface{}{})
+	for i := 0; i < 40; i++ {
+		value = map[string]interface{}{"a": value}
+	}
+
+	start := time.Now()
+	err := validateJSONSchema(schema, value)
+	if err == nil || !strings.Contains(err.Error(), "exceeded") {
+		t.Fatalf("validateJSONSchema = %v, want step budget error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("validateJSONSchema took %v", elapsed)
+	}
+}
+
+func TestCheckSchemaRefs(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		cyclic bool
+	}{
+		{"no refs", `{"type":"object","properties":{"a":{"type":"string"}}}`, false},
+		{"recursive through properties", `{"properties":{"child":{"$ref":"#"}}}`, false},
+		{"recursive through items", `{"$defs":{"node":{"items":{"$ref":"#/$defs/node"}}},"$ref":"#/$defs/node"}`, false},
+		{"branch nests back to root", `{"anyOf":[{"properties":{"child":{"$ref":"#"}}},{"type":"null"}]}`, false},
+		{"shared definition", `{"$defs":{"s":{"type":"string"}},"anyOf":[{"$ref":"#/$defs/s"},{"$ref":"#/$defs/s"}]}`, false},
+		{"self ref", `{"$ref":"#"}`, true},
+		{"oneOf self ref", `{"oneOf":[{"$ref":"#"},{"$ref":"#"}]}`, true},
+		{"defs cycle", `{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"allOf":[{"$ref":"#/$defs/a"}]}},"properties":{"x":{"$ref":"#/$defs/a"}}}`, true},
+		{"unused defs cycle", `{"$defs":{"a":{"anyOf":[{"$ref":"#/$defs/a"}]}}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSchemaRefs(mustDecodeJSON(t, tt.schema))
+			if (err != nil) != tt.cyclic {
+				t.Fatalf("checkSchemaRefs(%s) = %v, want cyclic %v", tt.schema, err, tt.cyclic)
+			}
+		})
+	}
+}
+
+func TestParseResponseFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		rf      *ResponseFormat
+		want    string
+		wantErr string
+	}{
+		{"nil", nil, "", ""},
+		{"text", &ResponseFormat{Type: ResponseFormatText}, "", ""},
+		{"json object", &ResponseFormat{Type: ResponseFormatJSONObject}, ResponseFormatJSONObject, ""},
+		{"schema", &ResponseFormat{Type: ResponseFormatJSONSchema, JSONSchema: &JSONSchemaFormat{Name: "s", Schema: json.RawMessage(`{"type":"object"}`)}}, ResponseFormatJSONSchema, ""},
+		{"missing name", &ResponseFormat{Type: ResponseFormatJSONSchema, JSONSchema: &JSONSchemaFormat{}}, "", "name: required"},
+		{"schema not object", &ResponseFormat{Type: ResponseFormatJSONSchema, JSONSchema: &JSONSchemaFormat{Name: "s", Schema: json.RawMessage(`[1]`)}}, "", "must be an object"},
+		{"ref cycle", &ResponseFormat{Type: ResponseFormatJSONSchema, JSONSchema: &JSONSchemaFormat{Name: "s", Schema: json.RawMessage(`{"oneOf":[{"$ref":"#"},{"$ref":"#"}]}`)}}, "", "$ref cycle"},
+		{"unknown type", &ResponseFormat{Type: "xml"}, "", "must be one of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := parseResponseFormat(tt.rf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseResponseFormat = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResponseFormat: %v", err)
+			}
+			got := ""
+			if out != nil {
+				got = out.Type
+			}
+			if got != tt.want {
+				t.Fatalf("parseResponseFormat type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructuredExtract(t *testing.T) {
+	s := &structuredOutput{Type: ResponseFormatJSONObject}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"plain", `{"a":1}`, `{"a":1}`},
+		{"surrounding whitespace", "\n  {\"a\":1}\n", `{"a":1}`},
+		{"json fence", "```json\n{\"a\":1}\n```", `{"a":1}`},
+		{"bare fence", "```\n{\"a\":1}\n```", `{"a":1}`},
+		{"fence with prose", "Here you go:\n```json\n{\"a\":1}\n```\nDone.", `{"a":1}`},
+		{"fence without trailing newline", "```json\n{\"a\":1}```", `{"a":1}`},
+		{"fence inside valid json is kept", "\"```json\\n1\\n```\"", "\"```json\\n1\\n```\""},
+		{"no json", "sorry", "sorry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.extract(tt.content); got != tt.want {
+				t.Fatalf("extract(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+// grokTokenStream 构造只包含正文 token 的上游响应
+func grokTokenStream(t *testing.T, tokens ...string) *fhttp.Response {
+	t.Helper()
+	var b strings.Builder
+	for _, token := range tokens {
+		line, err := json.Marshal(GrokStreamResponse{Result: &GrokResult{Response: &GrokResponse{Token: token}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return &fhttp.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(b.String()))}
+}
+
+func TestCompleteStructured(t *testing.T) {
+	schema := &structuredOutput{
+		Type:   ResponseFormatJSONSchema,
+		Name:   "answer",
+		Schema: mustDecodeJSON(t, `{"type":"object","required":["answer"],"properties":{"answer":{"type":"integer"}}}`),
+	}
+	first := func(content string) completion {
+		return completion{
+			Message: &MessageResp{Role: "assistant", Content: content},
+			Usage:   Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		retry       []string // nil 表示重试请求失败
+		wantContent string
+		wantErr     string
+		wantRetries int
+	}{
+		{"valid first time", `{"answer":42}`, nil, `{"answer":42}`, "", 0},
+		{"fenced first time", "```json\n{\"answer\":42}\n```", nil, `{"answer":42}`, "", 0},
+		{"fixed by retry", `{"answer":"42"}`, []string{`{"answer"`, `:42}`}, `{"answer":42}`, "", 1},
+		{"still invalid after retry", `{"answer":"42"}`, []string{`{"answer":"x"}`}, "", "after one retry", 1},
+		{"retry request fails", `not json`, nil, "", "retry request failed", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retries := 0
+			var extra []Message
+			retry := func(msgs []Message) (*fhttp.Response, error) {
+				retries++
+				extra = msgs
+				if tt.retry == nil {
+					return nil, errors.New("upstream unavailable")
+				}
+				return grokTokenStream(t, tt.retry...), nil
+			}
+
+			got, err := completeStructured(first(tt.content), responseOptions{Structured: schema}, retry)
+			if retries != tt.wantRetries {
+				t.Fatalf("retries = %d, want %d", retries, tt.wantRetries)
+			}
+			if retries > 0 {
+				if len(extra) != 2 || extra[0].Content != tt.content || !strings.Contains(extra[1].Content.(string), "invalid") {
+					t.Fatalf("correction messages = %+v", extra)
+				}
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("completeStructured error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("completeStructured: %v", err)
+			}
+			if got.Message.Content != tt.wantContent {
+				t.Fatalf("content = %q, want %q", got.Message.Content, tt.wantContent)
+			}
+			if tt.wantRetries > 0 && got.Usage.CompletionTokens <= 5 {
+				t.Fatalf("usage = %+v, want retry tokens added", got.Usage)
+			}
+		})
+	}
+}
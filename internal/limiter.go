@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxStopSequences = 4
+
+// parseStop 解析 OpenAI stop 参数（字符串或字符串数组）
+func parseStop(stop interface{}) ([]string, error) {
+	var stops []string
+	switch v := stop.(type) {
+	case nil:
+	case string:
+		stops = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("stop: must be a string or an array of strings")
+			}
+			stops = append(stops, s)
+		}
+	default:
+		return nil, fmt.Errorf("stop: must be a string or an array of strings")
+	}
+
+	var result []string
+	for _, s := range stops {
+		if s != "" {
+			result = append(result, s)
+		}
+	}
+	if len(result) > maxStopSequences {
+		return nil, fmt.Errorf("stop: at most %d sequences are supported, got %d", maxStopSequences, len(result))
+	}
+	return result, nil
+}
+
+// resolveMaxTokens 取 max_completion_tokens，兼容旧的 max_tokens，0 表示不限制
+func resolveMaxTokens(req *ChatRequest) (int, error) {
+	max := req.MaxCompletionTokens
+	if max == nil {
+		max = req.MaxTokens
+	}
+	if max == nil {
+		return 0, nil
+	}
+	if *max < 1 {
+		return 0, fmt.Errorf("max_tokens: must be >= 1, got %d", *max)
+	}
+	return *max, nil
+}
+
+// outputLimiter 在代理侧执行 stop 序列和 token 上限：
+// 可能是 stop 序列前缀的正文先暂存，跨 chunk 匹配，命中后截断
+type outputLimiter struct {
+	stops        []string
+	maxTokens    int
+	tokens       int // 已输出的 completion token 估算值
+	held         string
+	contentRunes int
+	finishReason string
+}
+
+func newOutputLimiter(stops []string, maxTokens int) *outputLimiter {
+	return &outputLimiter{stops: stops, maxTokens: maxTokens}
+}
+
+// stopped 是否已因 stop 序列或 token 上限结束
+func (l *outputLimiter) stopped() bool {
+	return l.finishReason != ""
+}
+
+// FinishReason 返回 stop 或 length
+func (l *outputLimiter) FinishReason() string {
+	if l.finishReason == "" {
+		return "stop"
+	}
+	return l.finishReason
+}
+
+// budget 累计 token 数，超出上限时截断文本
+func (l *outputLimiter) budget(text string) string {
+	if text == "" {
+		return text
+	}
+	n := EstimateTokens(text)
+	if l.maxTokens <= 0 || l.tokens+n <= l.maxTokens {
+		l.tokens += n
+		return text
+	}
+	text = truncateToTokens(text, l.maxTokens-l.tokens)
+	l.tokens = l.maxTokens
+	l.finishReason = "length"
+	return text
+}
+
+// heldSuffix 返回 text 末尾可能是某个 stop 序列前缀的最长长度
+func (l *outputLimiter) heldSuffix(text string) int {
+	longest := 0
+	for _, stop := range l.stops {
+		for n := min(len(stop)-1, len(text)); n > longest; n-- {
+			if strings.HasSuffix(text, stop[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// push 处理一次增量，返回可以输出的部分
+func (l *outputLimiter) push(ev StreamEvent) StreamEvent {
+	if l.stopped() {
+		return StreamEvent{}
+	}
+
+	if ev.Reasoning != "" {
+		ev.Reasoning = l.budget(ev.Reasoning)
+		if l.stopped() {
+			ev.Content = ""
+			return l.trimAnnotations(ev)
+		}
+	}
+
+	if ev.Content == "" {
+		return ev
+	}
+
+	text := l.held + ev.Content
+	l.held = ""
+
+	cut := -1
+	for _, stop := range l.stops {
+		if i := strings.Index(text, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut >= 0 {
+		text = text[:cut]
+		l.finishReason = "stop"
+	} else if n := l.heldSuffix(text); n > 0 {
+		l.held = text[len(text)-n:]
+		text = text[:len(text)-n]
+	}
+
+	ev.Content = l.budget(text)
+	l.contentRunes += utf8.RuneCountInString(ev.Content)
+	return l.trimAnnotations(ev)
+}
+
+// flush 输出结束时释放暂存的正文
+func (l *outputLimiter) flush() StreamEvent {
+	if l.stopped() || l.held == "" {
+		return StreamEvent{}
+	}
+	text := l.budget(l.held)
+	l.held = ""
+	l.contentRunes += utf8.RuneCountInString(text)
+	return StreamEvent{Content: text}
+}
+
+// 截断后丢弃指向已删除正文的注解
+func (l *outputLimiter) trimAnnotations(ev StreamEvent) StreamEvent {
+	if !l.stopped() || len(ev.Annotations) == 0 {
+		return ev
+	}
+	var kept []Annotation
+	for _, a := range ev.Annotations {
+		if a.URLCitation == nil || a.URLCitation.EndIndex <= l.contentRunes {
+			kept = append(kept, a)
+		}
+	}
+	ev.Annotations = kept
+	return ev
+}
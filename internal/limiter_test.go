@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func citation(url string, start, end int) Annotation {
+	return Annotation{Type: "url_citation", URLCitation: &URLCitation{URL: url, StartIndex: start, EndIndex: end}}
+}
+
+func TestOutputLimiterPush(t *testing.T) {
+	tests := []struct {
+		name      string
+		stops     []string
+		maxTokens int
+		events    []StreamEvent
+		want      []string // 每次 push 输出的正文，最后一项为 flush 的输出
+		reasoning string
+		urls      []string // 保留下来的注解
+		finish    string
+	}{
+		{
+			name:   "no limits",
+			events: []StreamEvent{{Content: "hello "}, {Content: "world"}},
+			want:   []string{"hello ", "world", ""},
+			finish: "stop",
+		},
+		{
+			name:   "stop in one chunk",
+			stops:  []string{"END"},
+			events: []StreamEvent{{Content: "helloENDworld"}, {Content: "more"}},
+			want:   []string{"hello", "", ""},
+			finish: "stop",
+		},
+		{
+			name:   "stop split across chunks",
+			stops:  []string{"END"},
+			events: []StreamEvent{{Content: "hello E"}, {Content: "ND more"}},
+			want:   []string{"hello ", "", ""},
+			finish: "stop",
+		},
+		{
+			name:   "stop split across three chunks",
+			stops:  []string{"<|end|>"},
+			events: []StreamEvent{{Content: "ab<|"}, {Content: "en"}, {Content: "d|>cd"}},
+			want:   []string{"ab", "", "", ""},
+			finish: "stop",
+		},
+		{
+			name:   "earliest of several stops",
+			stops:  []string{"world", "lo"},
+			events: []StreamEvent{{Content: "hello world"}},
+			want:   []string{"hel", ""},
+			finish: "stop",
+		},
+		{
+			name:   "held prefix completes the stop in the next chunk",
+			stops:  []string{"END"},
+			events: []StreamEvent{{Content: "foo EN"}, {Content: "D? no, ENx"}},
+			want:   []string{"foo ", "", ""},
+			finish: "stop",
+		},
+		{
+			name:   "held prefix diverges",
+			stops:  []string{"END"},
+			events: []StreamEvent{{Content: "foo EN"}, {Content: "TRY"}},
+			want:   []string{"foo ", "ENTRY", ""},
+			finish: "stop",
+		},
+		{
+			name:   "held prefix released by flush",
+			stops:  []string{"END"},
+			events: []StreamEvent{{Content: "foo E"}},
+			want:   []string{"foo ", "E"},
+			finish: "stop",
+		},
+		{
+			name:      "token budget with CJK then ASCII",
+			maxTokens: 3,
+			events:    []StreamEvent{{Content: "你好"}, {Content: "abcdefgh"}, {Content: "more"}},
+			want:      []string{"你好", "abcd", "", ""},
+			finish:    "length",
+		},
+		{
+			name:      "token budget inside mixed chunk",
+			maxTokens: 2,
+			events:    []StreamEvent{{Content: "ab你好"}},
+			want:      []string{"ab你", ""},
+			finish:    "length",
+		},
+		{
+			name:      "held text counts toward the budget on flush",
+			stops:     []string{"世界和平"},
+			maxTokens: 2,
+			events:    []StreamEvent{{Content: "你世界"}},
+			want:      []string{"你", "世"},
+			finish:    "length",
+		},
+		{
+			name:      "reasoning exhausts the budget",
+			maxTokens: 1,
+			events:    []StreamEvent{{Reasoning: "abcdefgh", Content: "x"}, {Content: "y"}},
+			want:      []string{"", "", ""},
+			reasoning: "abcd",
+			finish:    "length",
+		},
+		{
+			name:  "annotations beyond the stop are dropped",
+			stops: []string{"STOP"},
+			events: []StreamEvent{{
+				Content:     "see [1] and STOP [2]",
+				Annotations: []Annotation{citation("https://a", 4, 7), citation("https://b", 17, 20)},
+			}},
+			want:   []string{"see [1] and ", ""},
+			urls:   []string{"https://a"},
+			finish: "stop",
+		},
+		{
+			name:      "annotations beyond the budget are counted in runes",
+			maxTokens: 3,
+			events: []StreamEvent{
+				{Content: "你好", Annotations: []Annotation{citation("https://a", 0, 2)}},
+				{Content: "世界", Annotations: []Annotation{citation("https://b", 2, 3), citation("https://c", 3, 4)}},
+			},
+			want:   []string{"你好", "世", ""},
+			urls:   []string{"https://a", "https://b"},
+			finish: "length",
+		},
+		{
+			name:      "annotations are kept until the limiter stops",
+			stops:     []string{"END"},
+			maxTokens: 100,
+			events:    []StreamEvent{{Content: "abc", Annotations: []Annotation{citation("https://a", 10, 20)}}},
+			want:      []string{"abc", ""},
+			urls:      []string{"https://a"},
+			finish:    "stop",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newOutputLimiter(tt.stops, tt.maxTokens)
+			var got, urls []string
+			var reasoning string
+			for _, ev := range tt.events {
+				out := l.push(ev)
+				got = append(got, out.Content)
+				reasoning += out.Reasoning
+				for _, a := range out.Annotations {
+					urls = append(urls, a.URLCitation.URL)
+				}
+			}
+			got = append(got, l.flush().Content)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			if reasoning != tt.reasoning {
+				t.Errorf("reasoning = %q, want %q", reasoning, tt.reasoning)
+			}
+			if !reflect.DeepEqual(urls, tt.urls) {
+				t.Errorf("annotations = %q, want %q", urls, tt.urls)
+			}
+			if l.FinishReason() != tt.finish {
+				t.Errorf("FinishReason() = %q, want %q", l.FinishReason(), tt.finish)
+			}
+		})
+	}
+}
+
+func TestOutputLimiterHeldSuffix(t *testing.T) {
+	l := newOutputLimiter([]string{"END", "<|im_end|>"}, 0)
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"foo", 0},
+		{"foo E", 1},
+		{"foo EN", 2},
+		{"foo END", 0}, // 完整的 stop 序列由 push 截断，不再暂存
+		{"foo <|im", 4},
+		{"x<|im_end|", 9},
+		{"<|im_end", 8},
+		{"EN<", 1},
+	}
+	for _, tt := range tests {
+		if got := l.heldSuffix(tt.text); got != tt.want {
+			t.Errorf("heldSuffix(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestOutputLimiterTrimAnnotations(t *testing.T) {
+	anns := []Annotation{citation("https://a", 0, 5), citation("https://b", 5, 10), {Type: "file_citation"}}
+	tests := []struct {
+		name         string
+		finish       string
+		contentRunes int
+		want         []string
+	}{
+		{"not stopped keeps all", "", 5, []string{"https://a", "https://b", ""}},
+		{"stopped drops beyond cut", "stop", 5, []string{"https://a", ""}},
+		{"end index equal to cut is kept", "length", 10, []string{"https://a", "https://b", ""}},
+		{"nothing emitted", "length", 0, []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &outputLimiter{finishReason: tt.finish, contentRunes: tt.contentRunes}
+			var got []string
+			for _, a := range l.trimAnnotations(StreamEvent{Annotations: anns}).Annotations {
+				url := ""
+				if a.URLCitation != nil {
+					url = a.URLCitation.URL
+				}
+				got = append(got, url)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("trimAnnotations = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,8 @@ package internal
 
 import (
 	"fmt"
-	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,8 +17,8 @@ const (
 )
 
 var (
-	currentLevel LogLevel = INFO
-	levelNames            = map[LogLevel]string{
+	currentLevel atomic.Int32
+	levelNames   = map[LogLevel]string{
 		DEBUG: "DEBUG",
 		INFO:  "INFO",
 		WARN:  "WARN",
@@ -33,22 +34,28 @@ var (
 	resetColor = "\033[0m"
 )
 
-func InitLogger() {
-	level := os.Getenv("LOG_LEVEL")
-	switch level {
-	case "debug", "DEBUG":
-		currentLevel = DEBUG
-	case "warn", "WARN":
-		currentLevel = WARN
-	case "error", "ERROR":
-		currentLevel = ERROR
-	default:
-		currentLevel = INFO
+func parseLogLevel(level string) (LogLevel, bool) {
+	switch strings.ToUpper(level) {
+	case "DEBUG":
+		return DEBUG, true
+	case "INFO", "":
+		return INFO, true
+	case "WARN":
+		return WARN, true
+	case "ERROR":
+		return ERROR, true
 	}
+	return INFO, false
+}
+
+// InitLogger 按当前配置设置日志级别，配置热重载后会再次调用
+func InitLogger() {
+	level, _ := parseLogLevel(GetConfig().LogLevel)
+	currentLevel.Store(int32(level))
 }
 
 func log(level LogLevel, format string, v ...interface{}) {
-	if level < currentLevel {
+	if int32(level) < currentLevel.Load() {
 		return
 	}
 	timestamp := time.Now().Format("2006/01/02 15:04:05")
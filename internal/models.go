@@ -1,16 +1,43 @@
 package internal
 
+import "encoding/json"
+
 const (
 	BaseURL   = "https://grok.com"
 	AssetsURL = "https://assets.grok.com"
 )
 
 type ModelConfig struct {
-	ModelName string
-	ModelMode string
+	ModelName string        `yaml:"model_name" json:"model_name"`
+	ModelMode string        `yaml:"model_mode" json:"model_mode"`
+	Aliases   []string      `yaml:"aliases" json:"aliases,omitempty"`
+	Defaults  ModelDefaults `yaml:"defaults" json:"defaults"`
+	Limits    ModelLimits   `yaml:"limits" json:"limits"`
+
+	// /v1/models 展示信息
+	DisplayName string `yaml:"display_name" json:"display_name,omitempty"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	OwnedBy     string `yaml:"owned_by" json:"owned_by,omitempty"`
+	Created     int64  `yaml:"created" json:"created,omitempty"`
+}
+
+// ModelDefaults 模型级默认请求参数，未设置时使用全局配置
+type ModelDefaults struct {
+	DisableSearch        *bool `yaml:"disable_search" json:"disable_search,omitempty"`
+	ForceConcise         *bool `yaml:"force_concise" json:"force_concise,omitempty"`
+	ImageGenerationCount *int  `yaml:"image_generation_count" json:"image_generation_count,omitempty"`
+	IsReasoning          *bool `yaml:"is_reasoning" json:"is_reasoning,omitempty"`
+}
+
+// ModelLimits 模型不支持的请求级功能，零值表示不限制
+type ModelLimits struct {
+	DisableDeepSearch      bool `yaml:"disable_deepsearch" json:"disable_deepsearch,omitempty"`
+	DisableImageGeneration bool `yaml:"disable_image_generation" json:"disable_image_generation,omitempty"`
+	MaxImageCount          int  `yaml:"max_image_count" json:"max_image_count,omitempty"`
 }
 
-var ModelMapping = map[string]ModelConfig{
+// 内置模型表，配置文件未定义 models 时使用
+var DefaultModelMapping = map[string]ModelConfig{
 	"grok-3": {
 		ModelName: "grok-3",
 		ModelMode: "MODEL_MODE_FAST",
@@ -27,10 +54,6 @@ var ModelMapping = map[string]ModelConfig{
 		ModelName: "grok-4-mini-thinking-tahoe",
 		ModelMode: "MODEL_MODE_GROK_4_MINI_THINKING",
 	},
-	// "grok-4.1": {
-	// 	ModelName: "grok-4-1-non-thinking-w-tool",
-	// 	ModelMode: "MODEL_MODE_GROK_4_1_NON_THINKING",
-	// },
 	"grok-4.1-thinking": {
 		ModelName: "grok-4-1-thinking-1129", // grok-4-1-thinking-1108b
 		ModelMode: "MODEL_MODE_GROK_4_1_THINKING",
@@ -41,47 +64,138 @@ type ContentPart struct {
 	Type     string    `json:"type"`
 	Text     string    `json:"text,omitempty"`
 	ImageURL *ImageURL `json:"image_url,omitempty"`
+	File     *FilePart `json:"file,omitempty"`
 }
 
 type ImageURL struct {
 	URL string `json:"url"`
 }
 
+// FilePart OpenAI file 内容块，file_data 与 file_id 二选一
+type FilePart struct {
+	FileData string `json:"file_data,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
 type Message struct {
 	Role    string      `json:"role"`
 	Content interface{} `json:"content"`
 }
 
-// ParseContent 解析消息内容，返回文本和图片URL列表
-func (m *Message) ParseContent() (text string, imageURLs []string) {
+// Attachment 消息中的图片或文件
+type Attachment struct {
+	Type     string // image / file
+	Data     string // 图片 URL、data URL 或纯 base64
+	FileID   string // 已上传文件的 ID
+	Filename string
+	Detail   string // 图片 detail：low / high / auto
+}
+
+// MessagePart 按原顺序排列的消息片段，Text 与 Attachment 二选一
+type MessagePart struct {
+	Text       string
+	Attachment *Attachment
+}
+
+// Parts 按原顺序解析消息内容
+func (m *Message) Parts() []MessagePart {
+	var parts []MessagePart
 	switch content := m.Content.(type) {
 	case string:
-		return content, nil
+		parts = append(parts, MessagePart{Text: content})
 	case []interface{}:
 		for _, item := range content {
 			if part, ok := item.(map[string]interface{}); ok {
 				partType, _ := part["type"].(string)
 				if partType == "text" {
 					if t, ok := part["text"].(string); ok {
-						text += t
+						parts = append(parts, MessagePart{Text: t})
 					}
 				} else if partType == "image_url" {
 					if imgURL, ok := part["image_url"].(map[string]interface{}); ok {
 						if url, ok := imgURL["url"].(string); ok {
-							imageURLs = append(imageURLs, url)
+							detail, _ := imgURL["detail"].(string)
+							parts = append(parts, MessagePart{Attachment: &Attachment{Type: "image", Data: url, Detail: detail}})
+						}
+					}
+				} else if partType == "file" {
+					if file, ok := part["file"].(map[string]interface{}); ok {
+						att := Attachment{Type: "file"}
+						att.Data, _ = file["file_data"].(string)
+						att.FileID, _ = file["file_id"].(string)
+						att.Filename, _ = file["filename"].(string)
+						if att.Data != "" || att.FileID != "" {
+							parts = append(parts, MessagePart{Attachment: &att})
 						}
 					}
 				}
 			}
 		}
 	}
-	return text, imageURLs
+	return parts
+}
+
+// ParseContent 解析消息内容，返回拼接后的文本和附件列表
+func (m *Message) ParseContent() (text string, attachments []Attachment) {
+	for _, part := range m.Parts() {
+		if part.Attachment != nil {
+			attachments = append(attachments, *part.Attachment)
+		} else {
+			text += part.Text
+		}
+	}
+	return text, attachments
 }
 
 type ChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
+	Model               string            `json:"model"`
+	Messages            []Message         `json:"messages"`
+	Stream              bool              `json:"stream"`
+	StreamOptions       *StreamOptions    `json:"stream_options,omitempty"`
+	N                   *int              `json:"n,omitempty"`
+	ReasoningEffort     string            `json:"reasoning_effort,omitempty"`
+	Stop                interface{}       `json:"stop,omitempty"` // string 或 []string
+	MaxTokens           *int              `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int              `json:"max_completion_tokens,omitempty"`
+	ResponseFormat      *ResponseFormat   `json:"response_format,omitempty"`
+	WebSearchOptions    *WebSearchOptions `json:"web_search_options,omitempty"`
+	Grok                *GrokOptions      `json:"grok,omitempty"`
+}
+
+// OpenAI web_search_options，携带即开启搜索
+type WebSearchOptions struct {
+	SearchContextSize string      `json:"search_context_size,omitempty"`
+	UserLocation      interface{} `json:"user_location,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// OpenAI response_format
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// GrokOptions 请求级 Grok 功能开关（扩展字段）
+type GrokOptions struct {
+	Search          *bool                  `json:"search,omitempty"`
+	ImageGeneration *bool                  `json:"image_generation,omitempty"`
+	ImageCount      *int                   `json:"image_count,omitempty"`
+	Concise         *bool                  `json:"concise,omitempty"`
+	ToolOverrides   map[string]interface{} `json:"tool_overrides,omitempty"`
+	DeepSearch      *bool                  `json:"deepsearch,omitempty"`
+	Citations       string                 `json:"citations,omitempty"`        // markdown / annotations / inline
+	ReasoningFormat string                 `json:"reasoning_format,omitempty"` // reasoning_content / think / reasoning / hidden
 }
 
 type ChatCompletionChunk struct {
@@ -90,6 +204,7 @@ type ChatCompletionChunk struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
 }
 
 type Choice struct {
@@ -100,15 +215,32 @@ type Choice struct {
 }
 
 type Delta struct {
-	Role             string `json:"role,omitempty"`
-	Content          string `json:"content,omitempty"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string       `json:"role,omitempty"`
+	Content          string       `json:"content,omitempty"`
+	ReasoningContent string       `json:"reasoning_content,omitempty"`
+	Reasoning        string       `json:"reasoning,omitempty"`
+	Annotations      []Annotation `json:"annotations,omitempty"`
 }
 
 type MessageResp struct {
-	Role             string `json:"role"`
-	Content          string `json:"content"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string       `json:"role"`
+	Content          string       `json:"content"`
+	ReasoningContent string       `json:"reasoning_content,omitempty"`
+	Reasoning        string       `json:"reasoning,omitempty"`
+	Annotations      []Annotation `json:"annotations,omitempty"`
+}
+
+// Annotation OpenAI 消息注解，目前只有 url_citation
+type Annotation struct {
+	Type        string       `json:"type"`
+	URLCitation *URLCitation `json:"url_citation,omitempty"`
+}
+
+type URLCitation struct {
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
 }
 
 type ChatCompletionResponse struct {
@@ -132,10 +264,24 @@ type ModelsResponse struct {
 }
 
 type ModelInfo struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID          string   `json:"id"`
+	Object      string   `json:"object"`
+	Created     int64    `json:"created"`
+	OwnedBy     string   `json:"owned_by"`
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
 }
 
 // Grok 上游请求格式
@@ -165,6 +311,7 @@ type GrokRequest struct {
 	IsAsyncChat                 bool                   `json:"isAsyncChat"`
 	DisableSelfHarmShortCircuit bool                   `json:"disableSelfHarmShortCircuit"`
 	CollectionIds               []interface{}          `json:"collectionIds"`
+	DeepsearchPreset            string                 `json:"deepsearchPreset,omitempty"`
 }
 
 type ResponseMetadata struct {
@@ -233,6 +380,14 @@ type ImageInfo struct {
 	Link     string `json:"link,omitempty"`
 }
 
+// CitationCard 引用卡片，正文中的 render_inline_citation 标签通过 card_id 引用
+type CitationCard struct {
+	ID       string `json:"id"`
+	CardType string `json:"cardType"`
+	URL      string `json:"url"`
+	Title    string `json:"title,omitempty"`
+}
+
 type CachedImageGen struct {
 	ImageURL string `json:"imageUrl,omitempty"`
 }
@@ -0,0 +1,450 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ollama API 请求与响应
+
+type OllamaMessage struct {
+	Role     string   `json:"role"`
+	Content  string   `json:"content"`
+	Thinking string   `json:"thinking,omitempty"`
+	Images   []string `json:"images,omitempty"` // base64 编码的图片
+}
+
+type OllamaOptions struct {
+	NumPredict *int     `json:"num_predict,omitempty"`
+	Stop       []string `json:"stop,omitempty"`
+}
+
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream,omitempty"` // 默认 true
+	Format   json.RawMessage `json:"format,omitempty"` // "json" 或 JSON Schema
+	Options  *OllamaOptions  `json:"options,omitempty"`
+	Think    interface{}     `json:"think,omitempty"` // bool 或 low / medium / high
+}
+
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	Suffix  string          `json:"suffix,omitempty"`
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *OllamaOptions  `json:"options,omitempty"`
+	Think   interface{}     `json:"think,omitempty"`
+}
+
+// ollamaDone 最后一条响应附带的结束原因和统计字段，时长单位为纳秒
+type ollamaDone struct {
+	DoneReason         string `json:"done_reason,omitempty"`
+	TotalDuration      int64  `json:"total_duration,omitempty"`
+	LoadDuration       int64  `json:"load_duration,omitempty"`
+	PromptEvalCount    int    `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64  `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int    `json:"eval_count,omitempty"`
+	EvalDuration       int64  `json:"eval_duration,omitempty"`
+}
+
+type ollamaChatChunk struct {
+	Model     string        `json:"model"`
+	CreatedAt string        `json:"created_at"`
+	Message   OllamaMessage `json:"message"`
+	Done      bool          `json:"done"`
+	*ollamaDone
+}
+
+type ollamaGenerateChunk struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Response  string `json:"response"`
+	Thinking  string `json:"thinking,omitempty"`
+	Done      bool   `json:"done"`
+	*ollamaDone
+}
+
+type ollamaModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type ollamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    ollamaModelDetails `json:"details"`
+}
+
+type ollamaShowResponse struct {
+	Modelfile    string                 `json:"modelfile"`
+	Parameters   string                 `json:"parameters"`
+	Template     string                 `json:"template"`
+	Details      ollamaModelDetails     `json:"details"`
+	ModelInfo    map[string]interface{} `json:"model_info"`
+	Capabilities []string               `json:"capabilities"`
+	ModifiedAt   string                 `json:"modified_at"`
+}
+
+// writeOllamaError 返回 Ollama 格式的错误
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// ollamaModelName 去掉 Ollama 客户端附加的 :latest 标签
+func ollamaModelName(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+func ollamaThinkEnabled(think interface{}) bool {
+	switch v := think.(type) {
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "false"
+	}
+	return false
+}
+
+// ollamaChatRequest 将 Ollama 的公共参数转换为 ChatRequest
+func ollamaChatRequest(model string, stream *bool, format json.RawMessage, options *OllamaOptions, think interface{}) (ChatRequest, error) {
+	req := ChatRequest{
+		Model:  ollamaModelName(model),
+		Stream: stream == nil || *stream,
+		Grok:   &GrokOptions{ReasoningFormat: ReasoningHidden},
+	}
+	if ollamaThinkEnabled(think) {
+		req.Grok.ReasoningFormat = ReasoningContentField
+	}
+
+	if options != nil {
+		// num_predict 为 -1 表示不限制
+		if options.NumPredict != nil && *options.NumPredict > 0 {
+			req.MaxTokens = options.NumPredict
+		}
+		if len(options.Stop) > 0 {
+			stops := make([]interface{}, len(options.Stop))
+			for i, s := range options.Stop {
+				stops[i] = s
+			}
+			req.Stop = stops
+		}
+	}
+
+	if f := strings.TrimSpace(string(format)); f != "" && f != "null" && f != `""` {
+		if f == `"json"` {
+			req.ResponseFormat = &ResponseFormat{Type: ResponseFormatJSONObject}
+		} else if strings.HasPrefix(f, "{") {
+			req.ResponseFormat = &ResponseFormat{
+				Type:       ResponseFormatJSONSchema,
+				JSONSchema: &JSONSchemaFormat{Name: "response", Schema: format},
+			}
+		} else {
+			return req, fmt.Errorf("format: must be \"json\" or a JSON schema object")
+		}
+	}
+	return req, nil
+}
+
+// ollamaMessage 将文本和 base64 图片转换为 OpenAI 格式的消息，图片走统一的上传流程
+func ollamaMessage(role, content string, images []string) Message {
+	if len(images) == 0 {
+		return Message{Role: role, Content: content}
+	}
+	parts := []interface{}{}
+	if content != "" {
+		parts = append(parts, map[string]interface{}{"type": "text", "text": content})
+	}
+	for _, img := range images {
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]interface{}{"url": img},
+		})
+	}
+	return Message{Role: role, Content: parts}
+}
+
+// HandleOllamaChat 兼容 Ollama POST /api/chat
+func HandleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ollamaReq OllamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&ollamaReq); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	req, err := ollamaChatRequest(ollamaReq.Model, ollamaReq.Stream, ollamaReq.Format, ollamaReq.Options, ollamaReq.Think)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, m := range ollamaReq.Messages {
+		req.Messages = append(req.Messages, ollamaMessage(m.Role, m.Content, m.Images))
+	}
+
+	serveOllama(w, r, &req, func(ev StreamEvent, done *ollamaDone) interface{} {
+		return ollamaChatChunk{
+			Model:      ollamaReq.Model,
+			CreatedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+			Message:    OllamaMessage{Role: "assistant", Content: ev.Content, Thinking: ev.Reasoning},
+			Done:       done != nil,
+			ollamaDone: done,
+		}
+	})
+}
+
+// HandleOllamaGenerate 兼容 Ollama POST /api/generate
+func HandleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ollamaReq OllamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&ollamaReq); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if ollamaReq.Suffix != "" {
+		writeOllamaError(w, http.StatusBadRequest, "suffix is not supported")
+		return
+	}
+
+	// 空 prompt 在 Ollama 中用于预加载模型，直接返回
+	if ollamaReq.Prompt == "" && len(ollamaReq.Images) == 0 {
+		if _, _, ok := LookupModel(ollamaModelName(ollamaReq.Model)); !ok && GetConfig().StrictModels {
+			writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", ollamaReq.Model))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ollamaGenerateChunk{
+			Model:      ollamaReq.Model,
+			CreatedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+			Done:       true,
+			ollamaDone: &ollamaDone{DoneReason: "load"},
+		})
+		return
+	}
+
+	req, err := ollamaChatRequest(ollamaReq.Model, ollamaReq.Stream, ollamaReq.Format, ollamaReq.Options, ollamaReq.Think)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if ollamaReq.System != "" {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: ollamaReq.System})
+	}
+	req.Messages = append(req.Messages, ollamaMessage("user", ollamaReq.Prompt, ollamaReq.Images))
+
+	serveOllama(w, r, &req, func(ev StreamEvent, done *ollamaDone) interface{} {
+		return ollamaGenerateChunk{
+			Model:      ollamaReq.Model,
+			CreatedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+			Response:   ev.Content,
+			Thinking:   ev.Reasoning,
+			Done:       done != nil,
+			ollamaDone: done,
+		}
+	})
+}
+
+// serveOllama 发起对话并以 NDJSON 流或单个 JSON 对象返回，chunk 负责构造对应接口的响应体，done 仅在最后一条非空
+func serveOllama(w http.ResponseWriter, r *http.Request, req *ChatRequest, chunk func(ev StreamEvent, done *ollamaDone) interface{}) {
+	start := time.Now()
+
+	token := RequestToken(r)
+	if token == "" {
+		writeOllamaError(w, http.StatusUnauthorized, "Missing Authorization header")
+		return
+	}
+	run, err := startChat(r.Context(), req, token)
+	if err != nil {
+		writeOllamaError(w, chatErrorStatus(err), err.Error())
+		return
+	}
+	defer run.Close()
+
+	opts := run.Opts
+	c := run.Choices[0]
+	opts.Cookie = c.Cookie
+
+	var firstToken time.Time
+	final := func(ev StreamEvent, outcome choiceOutcome) interface{} {
+		end := time.Now()
+		if firstToken.IsZero() {
+			firstToken = end
+		}
+		return chunk(ev, &ollamaDone{
+			DoneReason:         outcome.FinishReason,
+			TotalDuration:      end.Sub(start).Nanoseconds(),
+			PromptEvalCount:    outcome.Usage.PromptTokens,
+			PromptEvalDuration: firstToken.Sub(start).Nanoseconds(),
+			EvalCount:          outcome.Usage.CompletionTokens,
+			EvalDuration:       end.Sub(firstToken).Nanoseconds(),
+		})
+	}
+
+	if !req.Stream {
+		opts.Progress = func(StreamEvent) {
+			if firstToken.IsZero() {
+				firstToken = time.Now()
+			}
+		}
+		// 与其他前端一致：结构化输出校验失败时重试一次，错误按类型返回对应状态码
+		result, err := completeChoice(c, opts, run.Send)
+		if err != nil {
+			writeOllamaError(w, chatErrorStatus(err), err.Error())
+			return
+		}
+		ev := StreamEvent{Content: result.Message.Content, Reasoning: result.Message.ReasoningContent + result.Message.Reasoning}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(final(ev, choiceOutcome{FinishReason: result.FinishReason, Usage: result.Usage}))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	enc := json.NewEncoder(w)
+
+	outcome := runChoice(c.Resp.Body, opts, func(ev StreamEvent) {
+		if ev.Content == "" && ev.Reasoning == "" {
+			return
+		}
+		if firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+		enc.Encode(chunk(ev, nil))
+		flusher.Flush()
+	})
+	if outcome.UpstreamError {
+		enc.Encode(map[string]string{"error": upstreamFailure(outcome.RateLimited).Error()})
+		flusher.Flush()
+		return
+	}
+	if opts.Structured != nil {
+		if _, err := opts.Structured.validate(outcome.Content); err != nil {
+			LogWarn("Structured output failed validation: %v", err)
+			enc.Encode(map[string]string{"error": err.Error()})
+			flusher.Flush()
+			return
+		}
+	}
+	enc.Encode(final(StreamEvent{}, outcome))
+	flusher.Flush()
+}
+
+func ollamaDetails() ollamaModelDetails {
+	return ollamaModelDetails{
+		Format:   "api",
+		Family:   "grok",
+		Families: []string{"grok"},
+	}
+}
+
+func ollamaModifiedAt(m ModelConfig) string {
+	created := m.Created
+	if created == 0 {
+		created = 1700000000
+	}
+	return time.Unix(created, 0).UTC().Format(time.RFC3339)
+}
+
+// HandleOllamaTags 兼容 Ollama GET /api/tags
+func HandleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	catalog := ModelCatalog()
+	ids := make([]string, 0, len(catalog))
+	for id := range catalog {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	models := []ollamaModel{}
+	for _, id := range ids {
+		sum := sha256.Sum256([]byte(id))
+		models = append(models, ollamaModel{
+			Name:       id,
+			Model:      id,
+			ModifiedAt: ollamaModifiedAt(catalog[id]),
+			Digest:     hex.EncodeToString(sum[:]),
+			Details:    ollamaDetails(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
+}
+
+// HandleOllamaShow 兼容 Ollama POST /api/show
+func HandleOllamaShow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"` // 旧版本字段
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	name := req.Model
+	if name == "" {
+		name = req.Name
+	}
+
+	id, m, ok := LookupModel(ollamaModelName(name))
+	if !ok {
+		writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", name))
+		return
+	}
+
+	capabilities := []string{"completion", "vision"}
+	if m.Defaults.IsReasoning != nil && *m.Defaults.IsReasoning {
+		capabilities = append(capabilities, "thinking")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ollamaShowResponse{
+		Template: "{{ .Prompt }}",
+		Details:  ollamaDetails(),
+		ModelInfo: map[string]interface{}{
+			"general.architecture": "grok",
+			"general.basename":     id,
+		},
+		Capabilities: capabilities,
+		ModifiedAt:   ollamaModifiedAt(m),
+	})
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var poolCursor uint64
+
+// NextPoolToken 轮询返回令牌池中的下一个令牌，池为空时返回空字符串
+func NextPoolToken() string {
+	tokens := GetConfig().Tokens
+	if len(tokens) == 0 {
+		return ""
+	}
+	i := atomic.AddUint64(&poolCursor, 1) - 1
+	return tokens[i%uint64(len(tokens))]
+}
+
+// BearerToken 从 Authorization 请求头中取出 sso 令牌
+func BearerToken(r *http.Request) string {
+	return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// RequestToken 优先使用 Authorization 中的令牌；未携带且开启 anonymous_use_pool 时从令牌池中选取，
+// 用于不支持鉴权的客户端。返回空字符串时调用方应返回 401
+func RequestToken(r *http.Request) string {
+	if token := BearerToken(r); token != "" {
+		return token
+	}
+	if !GetConfig().AnonymousUsePool {
+		return ""
+	}
+	return NextPoolToken()
+}
+
+// BuildCookie 由 sso 令牌构造上游 Cookie
+func BuildCookie(token string) string {
+	return fmt.Sprintf("sso-rw=%s;sso=%s", token, token)
+}
+
+// maskToken 仅保留令牌首尾少量字符，用于日志和错误信息
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return "***"
+	}
+	return token[:4] + "..." + token[len(token)-4:]
+}
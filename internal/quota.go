@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// QuotaConfig 按上游令牌和模型模式统计用量
+type QuotaConfig struct {
+	Window        int `yaml:"window" json:"window"`                 // 滚动统计窗口（秒），未查询到上游窗口时被限流的令牌在窗口重置前不再使用
+	QueryInterval int `yaml:"query_interval" json:"query_interval"` // 查询上游剩余额度的间隔（秒），0 表示不查询
+}
+
+// quotaUsage 一个令牌在一个模型模式下的用量
+type quotaUsage struct {
+	modelName      string      // 最近使用的上游模型，用于查询剩余额度
+	uses           []time.Time // 窗口内发起的对话
+	limited        []time.Time // 窗口内被上游限流的时间
+	remaining      int         // 上游返回的剩余次数，-1 表示未知
+	total          int
+	queriedAt      time.Time
+	exhaustedUntil time.Time // 额度耗尽（被限流或查询到剩余为 0）
+	backoffUntil   time.Time // 其他上游错误后的短暂回避，查询到剩余额度也不清除
+}
+
+// blockedUntil 暂停使用该令牌直到的时间
+func (u *quotaUsage) blockedUntil() time.Time {
+	if u.backoffUntil.After(u.exhaustedUntil) {
+		return u.backoffUntil
+	}
+	return u.exhaustedUntil
+}
+
+type quotaKey struct {
+	cookie string
+	mode   string
+}
+
+type quotaTracker struct {
+	mu    sync.Mutex
+	usage map[quotaKey]*quotaUsage
+}
+
+var quotas = &quotaTracker{usage: make(map[quotaKey]*quotaUsage)}
+
+func quotaWindow() time.Duration {
+	return time.Duration(GetConfig().Quota.Window) * time.Second
+}
+
+// entry 取出并清理过期记录，调用方需持有锁
+func (t *quotaTracker) entry(cookie, mode string) *quotaUsage {
+	key := quotaKey{cookie, mode}
+	u, ok := t.usage[key]
+	if !ok {
+		u = &quotaUsage{remaining: -1}
+		t.usage[key] = u
+	}
+	cutoff := time.Now().Add(-quotaWindow())
+	u.uses = dropBefore(u.uses, cutoff)
+	u.limited = dropBefore(u.limited, cutoff)
+	return u
+}
+
+func dropBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// recordUse 上游接受了一次对话
+func (t *quotaTracker) recordUse(cookie, mode, modelName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.usage) > maxIdleBuckets {
+		t.prune()
+	}
+	u := t.entry(cookie, mode)
+	u.modelName = modelName
+	u.uses = append(u.uses, time.Now())
+	if u.remaining > 0 {
+		u.remaining--
+	}
+}
+
+// prune 删除窗口内没有记录且未耗尽的条目，调用方需持有锁
+func (t *quotaTracker) prune() {
+	now := time.Now()
+	for key := range t.usage {
+		u := t.entry(key.cookie, key.mode)
+		if len(u.uses) == 0 && len(u.limited) == 0 && !now.Before(u.blockedUntil()) {
+			delete(t.usage, key)
+		}
+	}
+}
+
+// recordLimited 上游返回限流：该令牌在该模式下暂停使用到窗口重置，开启查询时以上游返回的等待时间为准
+func (t *quotaTracker) recordLimited(cookie, mode string) {
+	t.mu.Lock()
+	now := time.Now()
+	u := t.entry(cookie, mode)
+	u.limited = append(u.limited, now)
+	reset := now.Add(quotaWindow())
+	if len(u.uses) > 0 {
+		reset = u.uses[0].Add(quotaWindow())
+	}
+	if reset.After(u.exhaustedUntil) {
+		u.exhaustedUntil = reset
+	}
+	modelName := u.modelName
+	t.mu.Unlock()
+
+	LogWarn("Token %s rate limited for %s until %s", maskCookie(cookie), mode, reset.Format(time.RFC3339))
+	if GetConfig().Quota.QueryInterval > 0 && modelName != "" {
+		go t.refresh(cookie, mode, modelName)
+	}
+}
+
+// quotaErrorBackoff 上游返回限流以外的错误后该令牌在该模式下暂停使用的时间
+const quotaErrorBackoff = time.Minute
+
+// recordError 上游返回限流以外的错误（审核、参数等），不视为额度耗尽，只短暂避开该令牌
+func (t *quotaTracker) recordError(cookie, mode string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.entry(cookie, mode)
+	if until := time.Now().Add(quotaErrorBackoff); until.After(u.backoffUntil) {
+		u.backoffUntil = until
+	}
+}
+
+// exhausted 返回令牌在该模式下是否已知耗尽，以及预计恢复时间
+func (t *quotaTracker) exhausted(cookie, mode string) (bool, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.usage[quotaKey{cookie, mode}]
+	if !ok || !time.Now().Before(u.blockedUntil()) {
+		return false, time.Time{}
+	}
+	return true, u.blockedUntil()
+}
+
+// rateLimitsResponse 上游 /rest/rate-limits 的返回
+type rateLimitsResponse struct {
+	WindowSizeSeconds int  `json:"windowSizeSeconds"`
+	RemainingQueries  *int `json:"remainingQueries"`
+	TotalQueries      int  `json:"totalQueries"`
+	WaitTimeSeconds   int  `json:"waitTimeSeconds"`
+}
+
+// refresh 查询上游剩余额度，剩余为 0 时按返回的等待时间（或窗口）标记为耗尽
+func (t *quotaTracker) refresh(cookie, mode, modelName string) {
+	limits, err := queryRateLimits(cookie, modelName)
+	if err != nil {
+		LogWarn("Failed to query rate limits of token %s for %s: %v", maskCookie(cookie), mode, err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.entry(cookie, mode)
+	now := time.Now()
+	u.queriedAt = now
+	u.total = limits.TotalQueries
+	u.remaining = -1
+	if limits.RemainingQueries != nil {
+		u.remaining = *limits.RemainingQueries
+	}
+	switch {
+	case u.remaining == 0 && limits.WaitTimeSeconds > 0:
+		u.exhaustedUntil = now.Add(time.Duration(limits.WaitTimeSeconds) * time.Second)
+	case u.remaining == 0 && limits.WindowSizeSeconds > 0 && !u.exhaustedUntil.After(now):
+		u.exhaustedUntil = now.Add(time.Duration(limits.WindowSizeSeconds) * time.Second)
+	case u.remaining > 0:
+		u.exhaustedUntil = time.Time{}
+	}
+	LogDebug("Token %s has %d/%d queries left for %s", maskCookie(cookie), u.remaining, u.total, mode)
+}
+
+func queryRateLimits(cookie, modelName string) (*rateLimitsResponse, error) {
+	body, _ := json.Marshal(map[string]string{
+		"requestKind": "DEFAULT",
+		"modelName":   modelName,
+	})
+	req, err := fhttp.NewRequest("POST", BaseURL+"/rest/rate-limits", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	SetChatHeaders(req, cookie)
+
+	client := GetHTTPClient()
+	if client == nil {
+		return nil, fmt.Errorf("failed to create TLS client")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var limits rateLimitsResponse
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+// StartQuotaRefresh 周期性查询令牌池中各令牌已使用过的模式的剩余额度，间隔随配置热重载生效
+func StartQuotaRefresh() {
+	go func() {
+		for {
+			cfg := GetConfig()
+			if cfg.Quota.QueryInterval <= 0 || len(cfg.Tokens) == 0 {
+				time.Sleep(10 * time.Second)
+				continue
+			}
+
+			type target struct{ cookie, mode, modelName string }
+			var targets []target
+			quotas.mu.Lock()
+			for key, u := range quotas.usage {
+				if u.modelName != "" && isPoolCookie(key.cookie) {
+					targets = append(targets, target{key.cookie, key.mode, u.modelName})
+				}
+			}
+			quotas.mu.Unlock()
+			for _, t := range targets {
+				quotas.refresh(t.cookie, t.mode, t.modelName)
+			}
+
+			time.Sleep(time.Duration(cfg.Quota.QueryInterval) * time.Second)
+		}
+	}()
+}
+
+// maskCookie 取出 Cookie 中的令牌并脱敏
+func maskCookie(cookie string) string {
+	return maskToken(cookie[strings.LastIndex(cookie, "=")+1:])
+}
+
+func isPoolCookie(cookie string) bool {
+	return slices.ContainsFunc(GetConfig().Tokens, func(token string) bool {
+		return BuildCookie(token) == cookie
+	})
+}
+
+var availableCursor uint64
+
+// nextAvailableToken 轮询令牌池，跳过在该模式下已知耗尽的令牌；全部耗尽时返回空字符串和最早的恢复时间
+func nextAvailableToken(mode string) (string, time.Time) {
+	tokens := GetConfig().Tokens
+	var earliest time.Time
+	start := atomic.AddUint64(&availableCursor, 1) - 1
+	for i := range tokens {
+		token := tokens[(start+uint64(i))%uint64(len(tokens))]
+		exhausted, until := quotas.exhausted(BuildCookie(token), mode)
+		if !exhausted {
+			return token, time.Time{}
+		}
+		if earliest.IsZero() || until.Before(earliest) {
+			earliest = until
+		}
+	}
+	return "", earliest
+}
+
+// selectPoolToken 令牌来自令牌池且在该模式下已耗尽时换用池中其他令牌，调用方自带的令牌不替换
+func selectPoolToken(token, mode string) (string, error) {
+	if !slices.Contains(GetConfig().Tokens, token) {
+		return token, nil
+	}
+	if exhausted, _ := quotas.exhausted(BuildCookie(token), mode); !exhausted {
+		return token, nil
+	}
+	next, until := nextAvailableToken(mode)
+	if next == "" {
+		return "", &rateLimitError{Scope: "quota", RetryAfter: time.Until(until)}
+	}
+	LogDebug("Token %s exhausted for %s, using %s", maskToken(token), mode, maskToken(next))
+	return next, nil
+}
+
+// QuotaStatus 令牌在一个模型模式下的用量
+type QuotaStatus struct {
+	Mode           string `json:"mode"`
+	Requests       int    `json:"requests"`     // 窗口内发起的对话数
+	RateLimited    int    `json:"rate_limited"` // 窗口内被上游限流的次数
+	Remaining      *int   `json:"remaining,omitempty"`
+	Total          int    `json:"total,omitempty"`
+	QueriedAt      string `json:"queried_at,omitempty"`
+	ExhaustedUntil string `json:"exhausted_until,omitempty"`
+}
+
+type TokenQuota struct {
+	Token string        `json:"token"` // 脱敏后的令牌
+	Modes []QuotaStatus `json:"modes"`
+}
+
+func (t *quotaTracker) status(token string) TokenQuota {
+	cookie := BuildCookie(token)
+	result := TokenQuota{Token: maskToken(token), Modes: []QuotaStatus{}}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.usage {
+		if key.cookie != cookie {
+			continue
+		}
+		u := t.entry(key.cookie, key.mode)
+		s := QuotaStatus{Mode: key.mode, Requests: len(u.uses), RateLimited: len(u.limited), Total: u.total}
+		if u.remaining >= 0 {
+			remaining := u.remaining
+			s.Remaining = &remaining
+		}
+		if !u.queriedAt.IsZero() {
+			s.QueriedAt = u.queriedAt.Format(time.RFC3339)
+		}
+		if until := u.blockedUntil(); time.Now().Before(until) {
+			s.ExhaustedUntil = until.Format(time.RFC3339)
+		}
+		result.Modes = append(result.Modes, s)
+	}
+	slices.SortFunc(result.Modes, func(a, b QuotaStatus) int {
+		return strings.Compare(a.Mode, b.Mode)
+	})
+	return result
+}
+
+// HandleQuota 返回调用方自己令牌的上游用量，携带 admin_key 时返回令牌池的用量
+func HandleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+
+	var resp struct {
+		Pool []TokenQuota `json:"pool,omitempty"`
+		Self *TokenQuota  `json:"self,omitempty"`
+	}
+	if isAdminKey(token) {
+		resp.Pool = []TokenQuota{}
+		for _, t := range GetConfig().Tokens {
+			resp.Pool = append(resp.Pool, quotas.status(t))
+		}
+	} else {
+		self := quotas.status(token)
+		resp.Self = &self
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isAdminKey 判断 Authorization 值是否为配置的 admin_key
+func isAdminKey(token string) bool {
+	key := GetConfig().AdminKey
+	return key != "" && subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1
+}
@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig 令牌桶限流：调用方（API key 或 IP）、上游令牌，以及每个上游模型的并发数
+type RateLimitConfig struct {
+	Enabled          bool `yaml:"enabled" json:"enabled"`
+	ClientRPM        int  `yaml:"client_rpm" json:"client_rpm"` // 每个调用方每分钟请求数，0 表示不限制，可被 keys 中的 rpm 覆盖
+	ClientBurst      int  `yaml:"client_burst" json:"client_burst"`
+	TokenRPM         int  `yaml:"token_rpm" json:"token_rpm"` // 每个上游令牌每分钟发起的对话数，0 表示不限制
+	TokenBurst       int  `yaml:"token_burst" json:"token_burst"`
+	ModelConcurrency int  `yaml:"model_concurrency" json:"model_concurrency"` // 每个上游模型同时处理的请求数（多个候选和重试共用名额），0 表示不限制
+	QueueTimeout     int  `yaml:"queue_timeout" json:"queue_timeout"`         // 超出限制时排队等待的最长时间（秒），0 表示立即返回 429
+}
+
+// rateLimitError 排队超时仍未取得名额
+type rateLimitError struct {
+	Scope      string // client / token / model
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("Rate limit exceeded (%s), retry after %ds", e.Scope, retryAfterSeconds(e.RetryAfter))
+}
+
+// Is 与上游限流一样按 429 处理
+func (e *rateLimitError) Is(target error) bool {
+	return target == errRateLimited
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+func writeRateLimitError(w http.ResponseWriter, err *rateLimitError) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(err.RetryAfter)))
+	writeError(w, http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded", err.Error())
+}
+
+// reservation 一次令牌桶预占的结果
+type reservation struct {
+	Limit     int           // 每分钟请求数
+	Remaining int           // 预占后剩余的名额
+	Reset     time.Duration // 桶恢复满额所需时间
+	Wait      time.Duration // 需要等待多久才能使用预占的名额
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet 按键索引的令牌桶，速率取自当前配置，热重载后立即生效
+type bucketSet struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+const maxIdleBuckets = 1024
+
+var (
+	clientBuckets = &bucketSet{buckets: make(map[string]*tokenBucket)}
+	tokenBuckets  = &bucketSet{buckets: make(map[string]*tokenBucket)}
+)
+
+// reserve 预占一个名额，名额不足时允许透支并返回等待时间；等待超过 maxWait 时不占用，ok 为 false
+func (s *bucketSet) reserve(key string, rpm, burst int, maxWait time.Duration) (reservation, bool) {
+	rate := float64(rpm) / 60
+	capacity := float64(max(burst, 1))
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.buckets) > maxIdleBuckets {
+		s.prune(now, rate, capacity)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	b.tokens--
+	res := reservation{Limit: rpm}
+	if b.tokens < 0 {
+		res.Wait = time.Duration(-b.tokens / rate * float64(time.Second))
+	}
+	if res.Wait > maxWait {
+		b.tokens++
+	} else {
+		res.Remaining = max(0, int(b.tokens))
+	}
+	res.Reset = time.Duration((capacity - b.tokens) / rate * float64(time.Second))
+	return res, res.Wait <= maxWait
+}
+
+// prune 删除已恢复满额的桶，调用方需持有锁
+func (s *bucketSet) prune(now time.Time, rate, capacity float64) {
+	for key, b := range s.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= capacity {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// modelSlots 每个上游模型的并发名额
+type modelSlots struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+var upstreamSlots = &modelSlots{slots: make(map[string]chan struct{})}
+
+// acquire 等待 model 的并发名额直到 deadline，limit 变化后使用新的名额池
+func (m *modelSlots) acquire(ctx context.Context, model string, limit int, deadline time.Time) (func(), error) {
+	m.mu.Lock()
+	ch, ok := m.slots[model]
+	if !ok || cap(ch) != limit {
+		ch = make(chan struct{}, limit)
+		m.slots[model] = ch
+	}
+	m.mu.Unlock()
+
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	default:
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-timer.C:
+		return nil, &rateLimitError{Scope: "model", RetryAfter: time.Second}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type sharedSlotKey struct{}
+
+// sharedSlot 同一请求的多路候选和结构化输出重试共用一个模型并发名额，
+// 否则 n 超过 model_concurrency 时各路互相等待直到超时
+type sharedSlot struct {
+	mu      sync.Mutex
+	refs    int
+	release func()
+}
+
+// withSharedSlot 返回的 ctx 上发起的上游对话共用一个并发名额，ctx 上已有共享名额时原样返回，
+// 使一次请求中的多个提示（/v1/completions）也共用同一个名额
+func withSharedSlot(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(sharedSlotKey{}).(*sharedSlot); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, sharedSlotKey{}, &sharedSlot{})
+}
+
+func (s *sharedSlot) acquire(ctx context.Context, model string, limit int, deadline time.Time) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == 0 {
+		release, err := upstreamSlots.acquire(ctx, model, limit, deadline)
+		if err != nil {
+			return nil, err
+		}
+		s.release = release
+	}
+	s.refs++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.refs--; s.refs == 0 {
+			s.release()
+		}
+	}, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// clientIdentity 调用方标识：API key（Authorization、x-goog-api-key 或 key 查询参数）的哈希，均未携带时为来源 IP
+func clientIdentity(r *http.Request) (id, key string) {
+	key = BearerToken(r)
+	if key == "" {
+		key = r.Header.Get("x-goog-api-key")
+	}
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	if key != "" {
+		return "key:" + ownerID(key), key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, ""
+}
+
+// clientRPM 调用方每分钟请求数，keys 中的 rpm 优先
+func clientRPM(cfg *Config, key string) int {
+	if profile, ok := cfg.Keys[key]; ok && key != "" && profile.RPM > 0 {
+		return profile.RPM
+	}
+	return cfg.RateLimit.ClientRPM
+}
+
+// waitClientRate 不经过 WithRateLimit 的后台请求（批处理）按 key 所属调用方限流，
+// 等待直到取得名额，不受 queue_timeout 限制
+func waitClientRate(ctx context.Context, key string) error {
+	cfg := GetConfig()
+	rpm := clientRPM(cfg, key)
+	if !cfg.RateLimit.Enabled || key == "" || rpm <= 0 {
+		return nil
+	}
+	res, _ := clientBuckets.reserve("key:"+ownerID(key), rpm, cfg.RateLimit.ClientBurst, time.Duration(math.MaxInt64))
+	return sleepContext(ctx, res.Wait)
+}
+
+// WithRateLimit 按调用方限流，超出时排队至 queue_timeout，仍无名额时返回 429
+func WithRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := GetConfig()
+		rl := cfg.RateLimit
+		// 续传不产生新的上游请求
+		resume := r.Header.Get("Last-Event-ID") != "" && cfg.StreamResumeTTL > 0
+		if !rl.Enabled || r.Method == http.MethodOptions || resume {
+			next(w, r)
+			return
+		}
+
+		id, key := clientIdentity(r)
+		rpm := clientRPM(cfg, key)
+		if rpm <= 0 {
+			next(w, r)
+			return
+		}
+
+		res, ok := clientBuckets.reserve(id, rpm, rl.ClientBurst, time.Duration(rl.QueueTimeout)*time.Second)
+		w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(res.Limit))
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(res.Remaining))
+		w.Header().Set("x-ratelimit-reset-requests", res.Reset.Round(time.Millisecond).String())
+		if !ok {
+			LogInfo("Client rate limit exceeded for %s", id)
+			writeRateLimitError(w, &rateLimitError{Scope: "client", RetryAfter: res.Wait})
+			return
+		}
+		if res.Wait > 0 {
+			LogDebug("Client %s queued for %v", id, res.Wait)
+			if sleepContext(r.Context(), res.Wait) != nil {
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// acquireUpstream 发起上游对话前按令牌和模型限流，返回的 release 在对话结束时调用
+func acquireUpstream(ctx context.Context, model, cookie string) (func(), error) {
+	rl := GetConfig().RateLimit
+	if !rl.Enabled {
+		return func() {}, nil
+	}
+	deadline := time.Now().Add(time.Duration(rl.QueueTimeout) * time.Second)
+
+	if rl.TokenRPM > 0 {
+		res, ok := tokenBuckets.reserve(ownerID(cookie), rl.TokenRPM, rl.TokenBurst, time.Until(deadline))
+		if !ok {
+			return nil, &rateLimitError{Scope: "token", RetryAfter: res.Wait}
+		}
+		if err := sleepContext(ctx, res.Wait); err != nil {
+			return nil, err
+		}
+	}
+
+	if rl.ModelConcurrency > 0 {
+		acquire := upstreamSlots.acquire
+		if shared, ok := ctx.Value(sharedSlotKey{}).(*sharedSlot); ok {
+			acquire = shared.acquire
+		}
+		release, err := acquire(ctx, model, rl.ModelConcurrency, deadline)
+		if err != nil {
+			return nil, err
+		}
+		var once sync.Once
+		return func() { once.Do(release) }, nil
+	}
+	return func() {}, nil
+}
+
+// releaseOnClose 响应体读完或关闭时释放并发名额
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+// releaseUpstream 读取结束（包括因 stop 或长度限制提前结束）后立即释放并发名额，不必等到响应体关闭
+func releaseUpstream(body io.Reader) {
+	if b, ok := body.(*releaseOnClose); ok {
+		b.release()
+	}
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
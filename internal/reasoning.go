@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// 思考内容展示方式
+const (
+	ReasoningContentField = "reasoning_content" // 写入 reasoning_content 字段
+	ReasoningThinkTags    = "think"             // 以 <think>...</think> 内联到正文
+	ReasoningField        = "reasoning"         // 写入 reasoning 字段（OpenRouter 风格）
+	ReasoningHidden       = "hidden"            // 丢弃思考内容
+)
+
+func validReasoningFormat(format string) bool {
+	switch format {
+	case ReasoningContentField, ReasoningThinkTags, ReasoningField, ReasoningHidden:
+		return true
+	}
+	return false
+}
+
+// reasoningFormatter 按展示方式改写增量，think 模式下负责开闭标签
+type reasoningFormatter struct {
+	format  string
+	inThink bool
+	shift   int // 插入正文的标签字符数，用于修正注解位置
+}
+
+func newReasoningFormatter(format string) *reasoningFormatter {
+	return &reasoningFormatter{format: format}
+}
+
+func (f *reasoningFormatter) apply(ev StreamEvent) StreamEvent {
+	switch f.format {
+	case ReasoningHidden:
+		ev.Reasoning = ""
+	case ReasoningThinkTags:
+		var prefix string
+		if ev.Reasoning != "" {
+			if !f.inThink {
+				prefix = "<think>\n"
+				f.inThink = true
+			}
+			prefix += ev.Reasoning
+			ev.Reasoning = ""
+		}
+		if ev.Content != "" && f.inThink {
+			prefix += "\n</think>\n\n"
+			f.inThink = false
+		}
+		f.shift += utf8.RuneCountInString(prefix)
+		ev.Content = prefix + ev.Content
+	}
+
+	if f.shift > 0 && len(ev.Annotations) > 0 {
+		shifted := make([]Annotation, len(ev.Annotations))
+		for i, a := range ev.Annotations {
+			if a.URLCitation != nil {
+				c := *a.URLCitation
+				c.StartIndex += f.shift
+				c.EndIndex += f.shift
+				a.URLCitation = &c
+			}
+			shifted[i] = a
+		}
+		ev.Annotations = shifted
+	}
+	return ev
+}
+
+// finish 返回关闭未结束 think 标签所需的正文
+func (f *reasoningFormatter) finish() string {
+	if f.inThink {
+		f.inThink = false
+		return "\n</think>\n\n"
+	}
+	return ""
+}
+
+// eventChunk 将增量转换为流式 chunk
+func eventChunk(model string, ev StreamEvent, format string) ChatCompletionChunk {
+	chunk := createChunk(model, ev.Content, ev.Reasoning, false, false)
+	delta := chunk.Choices[0].Delta
+	delta.Annotations = ev.Annotations
+	if format == ReasoningField {
+		delta.Reasoning, delta.ReasoningContent = delta.ReasoningContent, ""
+	}
+	return chunk
+}
+
+// resolveReasoningFormat 依次使用请求参数、调用方配置和全局配置
+func resolveReasoningFormat(req *ChatRequest, token string) (string, error) {
+	cfg := GetConfig()
+	format := cfg.ReasoningFormat
+	if profile, ok := cfg.Keys[token]; ok && profile.ReasoningFormat != "" {
+		format = profile.ReasoningFormat
+	}
+	if req.Grok != nil && req.Grok.ReasoningFormat != "" {
+		format = req.Grok.ReasoningFormat
+		if !validReasoningFormat(format) {
+			return "", fmt.Errorf("grok.reasoning_format: must be one of reasoning_content, think, reasoning, hidden, got %q", format)
+		}
+	}
+	return format, nil
+}
+
+// applyReasoningEffort 按 reasoning_effort 选择模型：只在未指定模型或指定的模型本身在 reasoning_effort_models 中时替换，
+// 避免覆盖调用方明确指定的其他模型；未配置的取值（如 none）忽略
+func applyReasoningEffort(req *ChatRequest) error {
+	if req.ReasoningEffort == "" {
+		return nil
+	}
+	effortModels := GetConfig().ReasoningEffortModels
+	model, ok := effortModels[req.ReasoningEffort]
+	if !ok {
+		LogDebug("Ignoring unsupported reasoning_effort %q", req.ReasoningEffort)
+		return nil
+	}
+	if req.Model != "" && !isReasoningEffortModel(req.Model, effortModels) {
+		return nil
+	}
+	if _, _, exists := LookupModel(model); !exists {
+		return fmt.Errorf("reasoning_effort: mapped model %q is not available", model)
+	}
+	req.Model = model
+	return nil
+}
+
+// isReasoningEffortModel 判断 name（可为别名）是否为 reasoning_effort_models 中的某个模型
+func isReasoningEffortModel(name string, effortModels map[string]string) bool {
+	id, _, ok := LookupModel(name)
+	if !ok {
+		return false
+	}
+	for _, model := range effortModels {
+		if effortID, _, ok := LookupModel(model); ok && effortID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,475 @@
+package internal
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCacheConfig 相同请求的响应缓存
+type ResponseCacheConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	TTL     int  `yaml:"ttl" json:"ttl"`         // 缓存时间（秒）
+	MaxMB   int  `yaml:"max_mb" json:"max_mb"`   // 内存缓存上限（MB），按最近最少使用淘汰
+	Disk    bool `yaml:"disk" json:"disk"`       // 同时保存到 data_dir/cache，重启后仍可命中
+	DiskMB  int  `yaml:"disk_mb" json:"disk_mb"` // 磁盘缓存上限（MB），超出时删除最早写入的条目
+}
+
+// responseCacheEntry 缓存的完整响应，命中时替换 ID 和创建时间
+type responseCacheEntry struct {
+	Key       string                 `json:"key"`
+	ExpiresAt int64                  `json:"expires_at"`
+	Response  ChatCompletionResponse `json:"response"`
+	size      int
+}
+
+type responseCache struct {
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List // 最近使用的在前
+	bytes     int
+	lastSweep time.Time
+	diskBytes int64 // 上次清理后磁盘条目的总大小加上之后写入的字节数
+	sweeping  bool
+}
+
+var responses = &responseCache{
+	entries: make(map[string]*list.Element),
+	lru:     list.New(),
+}
+
+// cacheKeyMessage 规范化后的消息：字符串和文本片段等价，内联附件以内容哈希表示
+type cacheKeyMessage struct {
+	Role  string         `json:"role"`
+	Parts []cacheKeyPart `json:"parts"`
+}
+
+type cacheKeyPart struct {
+	Text     string `json:"text,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Source   string `json:"source,omitempty"` // sha256:<hex>、URL 或 file_id
+	Detail   string `json:"detail,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+// responseCacheKey 由调用方、模型、规范化的消息以及影响输出的参数计算缓存键
+func responseCacheKey(req *ChatRequest, token string) (string, bool) {
+	format, err := resolveReasoningFormat(req, token)
+	if err != nil {
+		return "", false
+	}
+	model := req.Model
+	if id, _, ok := LookupModel(req.Model); ok {
+		model = id
+	}
+
+	messages := make([]cacheKeyMessage, len(req.Messages))
+	for i, msg := range req.Messages {
+		m := cacheKeyMessage{Role: msg.Role, Parts: []cacheKeyPart{}}
+		for _, part := range msg.Parts() {
+			if part.Attachment == nil {
+				// 相邻文本片段合并，与发往上游的内容一致
+				if n := len(m.Parts); n > 0 && m.Parts[n-1].Type == "" {
+					m.Parts[n-1].Text += part.Text
+				} else {
+					m.Parts = append(m.Parts, cacheKeyPart{Text: part.Text})
+				}
+				continue
+			}
+			att := part.Attachment
+			m.Parts = append(m.Parts, cacheKeyPart{
+				Type:     att.Type,
+				Source:   attachmentSource(*att),
+				Detail:   att.Detail,
+				Filename: att.Filename,
+			})
+		}
+		messages[i] = m
+	}
+
+	data, err := json.Marshal(struct {
+		Owner               string            `json:"owner"`
+		Model               string            `json:"model"`
+		Messages            []cacheKeyMessage `json:"messages"`
+		N                   *int              `json:"n"`
+		ReasoningEffort     string            `json:"reasoning_effort"`
+		ReasoningFormat     string            `json:"reasoning_format"`
+		Stop                interface{}       `json:"stop"`
+		MaxTokens           *int              `json:"max_tokens"`
+		MaxCompletionTokens *int              `json:"max_completion_tokens"`
+		ResponseFormat      *ResponseFormat   `json:"response_format"`
+		WebSearchOptions    *WebSearchOptions `json:"web_search_options"`
+		Grok                *GrokOptions      `json:"grok"`
+	}{
+		Owner:               ownerID(token),
+		Model:               model,
+		Messages:            messages,
+		N:                   req.N,
+		ReasoningEffort:     req.ReasoningEffort,
+		ReasoningFormat:     format,
+		Stop:                req.Stop,
+		MaxTokens:           req.MaxTokens,
+		MaxCompletionTokens: req.MaxCompletionTokens,
+		ResponseFormat:      req.ResponseFormat,
+		WebSearchOptions:    req.WebSearchOptions,
+		Grok:                req.Grok,
+	})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// attachmentSource 内联数据取解码后内容的哈希，同一图片的不同编码方式命中同一缓存；
+// 远程图片按 URL 计算而不下载内容，同一 URL 的图片更新后仍会命中旧的响应
+func attachmentSource(att Attachment) string {
+	if att.FileID != "" {
+		return att.FileID
+	}
+	if strings.HasPrefix(att.Data, "http://") || strings.HasPrefix(att.Data, "https://") {
+		return att.Data
+	}
+	encoded := att.Data
+	if i := strings.Index(encoded, ","); strings.HasPrefix(encoded, "data:") && i >= 0 {
+		encoded = encoded[i+1:]
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		data = []byte(att.Data)
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// serveFromCache 命中时直接返回缓存的响应；未命中时返回用于写入缓存的键，不需要写入时为空
+func serveFromCache(w http.ResponseWriter, r *http.Request, req *ChatRequest) (string, bool) {
+	if !GetConfig().ResponseCache.Enabled {
+		return "", false
+	}
+	lookup, store := cacheDirective(r)
+	if !store {
+		w.Header().Set("X-Cache", "BYPASS")
+		return "", false
+	}
+	key, ok := responseCacheKey(req, BearerToken(r))
+	if !ok {
+		return "", false
+	}
+	if lookup {
+		if cached, hit := responses.get(key); hit {
+			LogDebug("Response cache hit: %s", key)
+			serveCachedResponse(w, cached, req)
+			return "", true
+		}
+		w.Header().Set("X-Cache", "MISS")
+	} else {
+		w.Header().Set("X-Cache", "BYPASS")
+	}
+	return key, false
+}
+
+// cacheDirective 解析请求头 Cache-Control：no-cache 跳过查找但更新缓存，no-store 完全不使用缓存
+func cacheDirective(r *http.Request) (lookup, store bool) {
+	lookup, store = true, true
+	for _, d := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(d)) {
+		case "no-cache":
+			lookup = false
+		case "no-store":
+			lookup, store = false, false
+		}
+	}
+	return lookup, store
+}
+
+func (c *responseCache) diskPath(key string) string {
+	return filepath.Join(GetConfig().DataDir, "cache", key+".json")
+}
+
+// get 先查内存，未命中时查磁盘并放入内存
+func (c *responseCache) get(key string) (*ChatCompletionResponse, bool) {
+	cfg := GetConfig().ResponseCache
+	now := time.Now().Unix()
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*responseCacheEntry)
+		if e.ExpiresAt > now {
+			c.lru.MoveToFront(el)
+			resp := e.Response
+			c.mu.Unlock()
+			return &resp, true
+		}
+		c.removeElement(el)
+	}
+	c.mu.Unlock()
+
+	if !cfg.Disk {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.diskPath(key))
+	if err != nil {
+		return nil, false
+	}
+	var e responseCacheEntry
+	if err := json.Unmarshal(data, &e); err != nil || e.ExpiresAt <= now {
+		os.Remove(c.diskPath(key))
+		return nil, false
+	}
+	e.size = len(data)
+	c.mu.Lock()
+	c.insert(&e)
+	c.mu.Unlock()
+	return &e.Response, true
+}
+
+func (c *responseCache) put(key string, resp ChatCompletionResponse) {
+	cfg := GetConfig().ResponseCache
+	e := &responseCacheEntry{
+		Key:       key,
+		ExpiresAt: time.Now().Add(time.Duration(cfg.TTL) * time.Second).Unix(),
+		Response:  resp,
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	e.size = len(data)
+
+	c.mu.Lock()
+	c.insert(e)
+	c.mu.Unlock()
+
+	if cfg.Disk {
+		if err := c.writeDisk(key, data); err != nil {
+			LogError("Failed to write response cache: %v", err)
+		}
+		c.sweepDisk(len(data))
+	}
+	LogDebug("Cached response %s", key)
+}
+
+// insert 放入内存并按 max_mb 淘汰最久未使用的条目，调用方需持有锁
+func (c *responseCache) insert(e *responseCacheEntry) {
+	if el, ok := c.entries[e.Key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[e.Key] = c.lru.PushFront(e)
+	c.bytes += e.size
+
+	limit := GetConfig().ResponseCache.MaxMB << 20
+	for c.bytes > limit && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *responseCache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*responseCacheEntry)
+	delete(c.entries, e.Key)
+	c.bytes -= e.size
+}
+
+// writeDisk 先写入同目录下的临时文件再重命名，并发写入同一个键时互不干扰
+func (c *responseCache) writeDisk(key string, data []byte) error {
+	path := c.diskPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// sweepDisk 删除磁盘上的过期条目和遗留的临时文件，总大小超过 disk_mb 时再按修改时间删除最早的条目。
+// 每个 TTL 周期最多清理一次，写入量超过上限时提前清理
+func (c *responseCache) sweepDisk(written int) {
+	cfg := GetConfig().ResponseCache
+	ttl := time.Duration(cfg.TTL) * time.Second
+	limit := int64(cfg.DiskMB) << 20
+	c.mu.Lock()
+	c.diskBytes += int64(written)
+	if c.sweeping || (time.Since(c.lastSweep) < ttl && c.diskBytes <= limit) {
+		c.mu.Unlock()
+		return
+	}
+	c.sweeping = true
+	c.lastSweep = time.Now()
+	c.mu.Unlock()
+
+	type diskEntry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []diskEntry
+	var total int64
+	paths, _ := filepath.Glob(filepath.Join(GetConfig().DataDir, "cache", "*"))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if time.Since(info.ModTime()) > ttl || (strings.HasSuffix(path, ".tmp") && time.Since(info.ModTime()) > time.Minute) {
+			os.Remove(path)
+			continue
+		}
+		if strings.HasSuffix(path, ".json") {
+			entries = append(entries, diskEntry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+	}
+	if total > limit {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+		for _, e := range entries {
+			if total <= limit {
+				break
+			}
+			if os.Remove(e.path) == nil {
+				total -= e.size
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.diskBytes = total
+	c.sweeping = false
+	c.mu.Unlock()
+}
+
+// serveCachedResponse 以新的 ID 返回缓存的响应，流式请求按 chunk 重放
+func serveCachedResponse(w http.ResponseWriter, cached *ChatCompletionResponse, req *ChatRequest) {
+	resp := *cached
+	resp.ID = fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	resp.Created = time.Now().Unix()
+	resp.Model = req.Model
+
+	w.Header().Set("X-Cache", "HIT")
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	chunk := func(index int, delta *Delta, finishReason *string) ChatCompletionChunk {
+		return ChatCompletionChunk{
+			ID:      resp.ID,
+			Object:  "chat.completion.chunk",
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: []Choice{{Index: index, Delta: delta, FinishReason: finishReason}},
+		}
+	}
+	for _, c := range resp.Choices {
+		writeSSE(w, chunk(c.Index, &Delta{Role: "assistant"}, nil))
+		m := c.Message
+		if m.ReasoningContent != "" || m.Reasoning != "" {
+			writeSSE(w, chunk(c.Index, &Delta{ReasoningContent: m.ReasoningContent, Reasoning: m.Reasoning}, nil))
+		}
+		if m.Content != "" || len(m.Annotations) > 0 {
+			writeSSE(w, chunk(c.Index, &Delta{Content: m.Content, Annotations: m.Annotations}, nil))
+		}
+		writeSSE(w, chunk(c.Index, nil, c.FinishReason))
+	}
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		final := chunk(0, nil, nil)
+		final.Choices = []Choice{}
+		final.Usage = &resp.Usage
+		writeSSE(w, final)
+	}
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// streamCollector 从流式输出的 chunk 还原完整响应，用于写入缓存
+type streamCollector struct {
+	opts     responseOptions
+	messages map[int]*MessageResp
+	finish   map[int]string
+	failed   bool
+}
+
+func newStreamCollector(opts responseOptions) *streamCollector {
+	return &streamCollector{
+		opts:     opts,
+		messages: make(map[int]*MessageResp),
+		finish:   make(map[int]string),
+	}
+}
+
+func (c *streamCollector) add(data []byte) {
+	var chunk struct {
+		ChatCompletionChunk
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &chunk) != nil {
+		return
+	}
+	if chunk.Error != nil {
+		c.failed = true
+		return
+	}
+	for _, choice := range chunk.Choices {
+		m, ok := c.messages[choice.Index]
+		if !ok {
+			m = &MessageResp{Role: "assistant"}
+			c.messages[choice.Index] = m
+		}
+		if d := choice.Delta; d != nil {
+			m.Content += d.Content
+			m.ReasoningContent += d.ReasoningContent
+			m.Reasoning += d.Reasoning
+			m.Annotations = append(m.Annotations, d.Annotations...)
+		}
+		if choice.FinishReason != nil {
+			c.finish[choice.Index] = *choice.FinishReason
+		}
+	}
+}
+
+// store 所有候选都正常结束时写入缓存
+func (c *streamCollector) store(usage Usage) {
+	if c.failed {
+		return
+	}
+	resp := ChatCompletionResponse{Object: "chat.completion", Model: c.opts.Model, Usage: usage}
+	for i := 0; i < len(c.messages); i++ {
+		m, ok := c.messages[i]
+		reason := c.finish[i]
+		if !ok || reason == "" || reason == "error" {
+			return
+		}
+		resp.Choices = append(resp.Choices, Choice{Index: i, Message: m, FinishReason: stringPtr(reason)})
+	}
+	responses.put(c.opts.CacheKey, resp)
+}
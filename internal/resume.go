@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamBuffer 缓存一次流式输出的全部 SSE 事件，客户端断线后可通过 Last-Event-ID 续传
+type streamBuffer struct {
+	mu        sync.Mutex
+	id        string
+	owner     string
+	events    [][]byte
+	done      bool
+	notify    chan struct{} // 有新事件或结束时关闭并替换
+	readers   int
+	idleSince time.Time
+	cancel    context.CancelFunc
+}
+
+func (b *streamBuffer) append(data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, data)
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+func (b *streamBuffer) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = true
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// since 返回从 from 开始的事件、是否已结束，以及等待后续事件的通道
+func (b *streamBuffer) since(from int) ([][]byte, bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events [][]byte
+	if from < len(b.events) {
+		events = b.events[from:len(b.events):len(b.events)]
+	}
+	return events, b.done, b.notify
+}
+
+func (b *streamBuffer) attach() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readers++
+}
+
+func (b *streamBuffer) detach() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.readers--
+	b.idleSince = time.Now()
+}
+
+// expired 无客户端连接超过 ttl
+func (b *streamBuffer) expired(ttl time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.readers == 0 && time.Since(b.idleSince) > ttl
+}
+
+// streamRegistry 按 completion ID 索引的流式缓冲区
+type streamRegistry struct {
+	mu      sync.Mutex
+	buffers map[string]*streamBuffer
+	sweep   sync.Once
+}
+
+var streams = &streamRegistry{buffers: make(map[string]*streamBuffer)}
+
+func (s *streamRegistry) create(id, owner string, cancel context.CancelFunc) *streamBuffer {
+	b := &streamBuffer{
+		id:        id,
+		owner:     owner,
+		notify:    make(chan struct{}),
+		idleSince: time.Now(),
+		cancel:    cancel,
+	}
+	s.mu.Lock()
+	s.buffers[id] = b
+	s.mu.Unlock()
+
+	s.sweep.Do(func() { go s.sweepLoop() })
+	return b
+}
+
+func (s *streamRegistry) get(id, owner string) (*streamBuffer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buffers[id]
+	if !ok || b.owner != owner {
+		return nil, false
+	}
+	return b, true
+}
+
+// sweepLoop 定期清除无人连接超过 stream_resume_ttl 的缓冲区，未结束的同时取消上游请求
+func (s *streamRegistry) sweepLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		ttl := time.Duration(GetConfig().StreamResumeTTL) * time.Second
+		s.mu.Lock()
+		for id, b := range s.buffers {
+			if b.expired(ttl) {
+				b.cancel()
+				delete(s.buffers, id)
+				LogDebug("Stream buffer %s expired", id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handleResumableStream 上游请求与客户端连接解耦，输出先写入缓冲区再转发给客户端
+func handleResumableStream(w http.ResponseWriter, r *http.Request, req *ChatRequest, cacheKey string) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	token := BearerToken(r)
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	run, err := startChat(ctx, req, token)
+	if err != nil {
+		cancel()
+		writeChatError(w, err)
+		return
+	}
+
+	run.Opts.CacheKey = cacheKey
+	buf := streams.create(run.Opts.ID, ownerID(token), cancel)
+	go func() {
+		defer cancel()
+		defer run.Close()
+		streamEvents(run.Choices, run.Opts, buf.append)
+		buf.finish()
+	}()
+
+	serveStreamBuffer(w, r, buf, 0)
+}
+
+// handleStreamResume 按 Last-Event-ID（<completion ID>:<序号>）续传
+func handleStreamResume(w http.ResponseWriter, r *http.Request, lastEventID string) {
+	id, seq, err := parseStreamEventID(lastEventID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	token := BearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing Authorization header")
+		return
+	}
+	buf, ok := streams.get(id, ownerID(token))
+	if !ok {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "stream_not_found",
+			fmt.Sprintf("Stream %s not found or expired", id))
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	LogInfo("Resuming stream %s after event %d", id, seq)
+	serveStreamBuffer(w, r, buf, seq+1)
+}
+
+func parseStreamEventID(lastEventID string) (string, int, error) {
+	i := strings.LastIndex(lastEventID, ":")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("Last-Event-ID: expected <id>:<sequence>, got %q", lastEventID)
+	}
+	seq, err := strconv.Atoi(lastEventID[i+1:])
+	if err != nil || seq < -1 {
+		return "", 0, fmt.Errorf("Last-Event-ID: invalid sequence in %q", lastEventID)
+	}
+	return lastEventID[:i], seq, nil
+}
+
+// serveStreamBuffer 从第 from 个事件开始转发，客户端断开时只结束转发，不影响上游读取
+func serveStreamBuffer(w http.ResponseWriter, r *http.Request, buf *streamBuffer, from int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	flusher := w.(http.Flusher)
+
+	buf.attach()
+	defer buf.detach()
+
+	next := from
+	for {
+		events, done, wait := buf.since(next)
+		for _, data := range events {
+			fmt.Fprintf(w, "id: %s:%d\ndata: %s\n\n", buf.id, next, data)
+			next++
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-wait:
+		case <-r.Context().Done():
+			LogDebug("Client disconnected from stream %s at event %d", buf.id, next)
+			return
+		}
+	}
+}
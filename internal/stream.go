@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 引用展示方式
+const (
+	CitationMarkdown    = "markdown"    // 搜索结果以 markdown 链接写入 reasoning_content
+	CitationAnnotations = "annotations" // 搜索结果作为 url_citation 注解返回
+	CitationInline      = "inline"      // 正文插入 [n] 编号并返回对应注解
+)
+
+func validCitationMode(mode string) bool {
+	switch mode {
+	case CitationMarkdown, CitationAnnotations, CitationInline:
+		return true
+	}
+	return false
+}
+
+var (
+	inlineCitationPattern = regexp.MustCompile(`(?s)<grok:render[^>]*type="render_inline_citation"[^>]*>.*?</grok:render>`)
+	renderCardIDPattern   = regexp.MustCompile(`card_id="([^"]*)"`)
+	citationIDPattern     = regexp.MustCompile(`<argument name="citation_id">\s*(\d+)\s*</argument>`)
+	// 私有区字符包裹的引用占位符，processToolResponse 处理完后再替换为 [n]
+	citationPlaceholderPattern = regexp.MustCompile("\uE000(\\d+)\uE001")
+)
+
+// StreamEvent 上游流解析出的一次增量
+type StreamEvent struct {
+	Content     string
+	Reasoning   string
+	Annotations []Annotation
+}
+
+// StreamResult 上游流结束后的汇总信息
+type StreamResult struct {
+	ConversationID string
+	ResponseID     string
+	ImageURLs      []string
+	UpstreamError  bool
+	RateLimited    bool // 上游错误为限流（额度耗尽），而非审核、参数等其他错误
+	ReadError      bool // 读取中断（连接重置、超时或请求被取消），输出可能不完整
+}
+
+type citationSource struct {
+	URL   string
+	Title string
+}
+
+// grokStreamParser 将 Grok 响应行转换为 OpenAI 风格的增量
+type grokStreamParser struct {
+	citationMode string
+	sources      []citationSource
+	sourceIndex  map[string]int    // URL -> 编号（从 1 开始）
+	cardSources  map[string]string // citation_card id -> URL
+	contentRunes int               // 已输出正文的字符数，用于计算注解位置
+}
+
+func newGrokStreamParser(citationMode string) *grokStreamParser {
+	return &grokStreamParser{
+		citationMode: citationMode,
+		sourceIndex:  make(map[string]int),
+		cardSources:  make(map[string]string),
+	}
+}
+
+// addSource 登记引用来源，返回编号以及是否为新来源
+func (p *grokStreamParser) addSource(url, title string) (int, bool) {
+	if n, ok := p.sourceIndex[url]; ok {
+		return n, false
+	}
+	p.sources = append(p.sources, citationSource{URL: url, Title: title})
+	n := len(p.sources)
+	p.sourceIndex[url] = n
+	return n, true
+}
+
+func (p *grokStreamParser) annotation(n, start, end int) Annotation {
+	src := p.sources[n-1]
+	return Annotation{
+		Type: "url_citation",
+		URLCitation: &URLCitation{
+			URL:        src.URL,
+			Title:      src.Title,
+			StartIndex: start,
+			EndIndex:   end,
+		},
+	}
+}
+
+// collectSources 从搜索结果和引用卡片中收集来源，annotations 模式下直接生成注解
+func (p *grokStreamParser) collectSources(data *GrokResponse, ev *StreamEvent) {
+	var found []citationSource
+	if data.WebSearchResults != nil {
+		for _, r := range data.WebSearchResults.Results {
+			if r.URL != "" {
+				found = append(found, citationSource{URL: r.URL, Title: r.Title})
+			}
+		}
+	}
+	if data.CardAttachment != nil && data.CardAttachment.JSONData != "" {
+		var card CitationCard
+		if err := json.Unmarshal([]byte(data.CardAttachment.JSONData), &card); err == nil &&
+			card.CardType == "citation_card" && card.URL != "" {
+			if card.ID != "" {
+				p.cardSources[card.ID] = card.URL
+			}
+			found = append(found, citationSource{URL: card.URL, Title: card.Title})
+		}
+	}
+
+	for _, src := range found {
+		n, isNew := p.addSource(src.URL, src.Title)
+		if isNew && p.citationMode == CitationAnnotations {
+			ev.Annotations = append(ev.Annotations, p.annotation(n, p.contentRunes, p.contentRunes))
+		}
+	}
+}
+
+// 将行内引用标签替换为占位符，无法识别来源的标签交由 processToolResponse 删除
+func (p *grokStreamParser) markInlineCitations(text string) string {
+	return inlineCitationPattern.ReplaceAllStringFunc(text, func(tag string) string {
+		if m := renderCardIDPattern.FindStringSubmatch(tag); m != nil {
+			if url, ok := p.cardSources[m[1]]; ok {
+				return fmt.Sprintf("\uE000%d\uE001", p.sourceIndex[url])
+			}
+		}
+		if m := citationIDPattern.FindStringSubmatch(tag); m != nil {
+			// citation_id 为搜索结果下标（从 0 开始）
+			if i, err := strconv.Atoi(m[1]); err == nil && i >= 0 && i < len(p.sources) {
+				return fmt.Sprintf("\uE000%d\uE001", i+1)
+			}
+		}
+		return tag
+	})
+}
+
+// 将占位符替换为 [n] 编号并生成对应位置的注解
+func (p *grokStreamParser) renderInlineCitations(text string, ev *StreamEvent) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range citationPlaceholderPattern.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(text[last:loc[0]])
+		n, _ := strconv.Atoi(text[loc[2]:loc[3]])
+		start := p.contentRunes + utf8.RuneCountInString(b.String())
+		marker := fmt.Sprintf("[%d]", n)
+		b.WriteString(marker)
+		ev.Annotations = append(ev.Annotations, p.annotation(n, start, start+len(marker)))
+		last = loc[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// handle 处理一条 Grok 响应
+func (p *grokStreamParser) handle(grokResp *GrokResponse) StreamEvent {
+	var ev StreamEvent
+
+	if p.citationMode != CitationMarkdown {
+		p.collectSources(grokResp, &ev)
+	}
+
+	isThinkingContent := grokResp.IsThinking && grokResp.MessageTag != "header"
+	isSearchResult := grokResp.MessageTag == "raw_function_result" && grokResp.WebSearchResults != nil
+
+	// 非 markdown 模式下搜索结果已转换为注解，不再写入思考内容
+	toReasoning := isThinkingContent || isSearchResult
+	if isSearchResult && p.citationMode != CitationMarkdown {
+		toReasoning = false
+	}
+	if toReasoning {
+		ev.Reasoning = processToolResponse(grokResp)
+	}
+
+	if !grokResp.IsThinking && grokResp.MessageTag != "tool_usage_card" && grokResp.MessageTag != "header" && grokResp.MessageTag != "raw_function_result" {
+		data := grokResp
+		if p.citationMode == CitationInline && grokResp.Token != "" {
+			copied := *grokResp
+			copied.Token = p.markInlineCitations(grokResp.Token)
+			data = &copied
+		}
+
+		content := processToolResponse(data)
+		if p.citationMode == CitationInline {
+			content = p.renderInlineCitations(content, &ev)
+		}
+		ev.Content = content
+		p.contentRunes += utf8.RuneCountInString(content)
+	}
+
+	return ev
+}
+
+// readGrokStream 逐行读取上游响应，每个非空增量回调一次 emit，emit 返回 false 时停止读取
+func readGrokStream(body io.Reader, citationMode string, emit func(StreamEvent) bool) StreamResult {
+	var result StreamResult
+	parser := newGrokStreamParser(citationMode)
+	scanner := bufio.NewScanner(body)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		var streamResp GrokStreamResponse
+		if err := json.Unmarshal([]byte(line), &streamResp); err != nil {
+			LogError("Failed to parse upstream response: %v, line: %s", err, line)
+			continue
+		}
+
+		LogDebug("Upstream response: %s", line)
+
+		if streamResp.Error != nil {
+			result.UpstreamError = true
+			result.RateLimited = isRateLimitError(streamResp.Error)
+			return result
+		}
+
+		data := streamResp.Result
+		if data == nil {
+			continue
+		}
+
+		if data.Conversation != nil && data.Conversation.ConversationID != "" {
+			result.ConversationID = data.Conversation.ConversationID
+		}
+
+		if data.Response == nil {
+			continue
+		}
+
+		grokResp := data.Response
+
+		if grokResp.ResponseID != "" {
+			result.ResponseID = grokResp.ResponseID
+		}
+
+		// 只收集最终图片（progress=100），过滤掉中间的 part 图片
+		if grokResp.StreamingImageGenerationResponse != nil && grokResp.StreamingImageGenerationResponse.ImageURL != "" {
+			if grokResp.StreamingImageGenerationResponse.Progress == 100 {
+				result.ImageURLs = append(result.ImageURLs, grokResp.StreamingImageGenerationResponse.ImageURL)
+			}
+		}
+		if grokResp.CachedImageGenerationResponse != nil && grokResp.CachedImageGenerationResponse.ImageURL != "" {
+			result.ImageURLs = append(result.ImageURLs, grokResp.CachedImageGenerationResponse.ImageURL)
+		}
+
+		ev := parser.handle(grokResp)
+		if ev.Content == "" && ev.Reasoning == "" && len(ev.Annotations) == 0 {
+			continue
+		}
+		if !emit(ev) {
+			return result
+		}
+	}
+
+	// 检查扫描器是否因错误而退出
+	if err := scanner.Err(); err != nil {
+		LogError("Scanner error while reading upstream response: %v", err)
+		result.ReadError = true
+	}
+
+	return result
+}
+
+// isRateLimitError 上游错误行是否表示限流：gRPC 状态码 8（RESOURCE_EXHAUSTED）或限流相关的错误信息
+func isRateLimitError(upstreamErr interface{}) bool {
+	detail, ok := upstreamErr.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	switch code := detail["code"].(type) {
+	case float64:
+		if code == 8 || code == 429 {
+			return true
+		}
+	case string:
+		if strings.EqualFold(code, "RESOURCE_EXHAUSTED") {
+			return true
+		}
+	}
+	message, _ := detail["message"].(string)
+	message = strings.ToLower(message)
+	return strings.Contains(message, "rate limit") || strings.Contains(message, "too many requests") || strings.Contains(message, "resource exhausted")
+}
+
+// imageMarkdown 分享会话以公开图片访问权限，返回追加到正文的图片 markdown
+func imageMarkdown(result StreamResult, cookie string) []string {
+	if len(result.ImageURLs) == 0 || result.ConversationID == "" || result.ResponseID == "" {
+		return nil
+	}
+
+	if err := shareConversation(result.ConversationID, result.ResponseID, cookie); err != nil {
+		LogError("Failed to share conversation: %v", err)
+	} else {
+		LogInfo("Conversation shared successfully: %s", result.ConversationID)
+	}
+
+	var parts []string
+	for i, imageURL := range result.ImageURLs {
+		fullURL := AssetsURL + "/" + imageURL
+		prefix := "\n"
+		if i == 0 {
+			prefix = "\n\n"
+		}
+		parts = append(parts, fmt.Sprintf("%s![image](%s)", prefix, fullURL))
+	}
+	return parts
+}
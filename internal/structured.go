@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	fhttp "github.com/bogdanfinn/fhttp"
+)
+
+// response_format 类型
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+var codeFencePattern = regexp.MustCompile("(?s)```[A-Za-z]*[ \\t]*\\n(.*?)\\n?[ \\t]*```")
+
+// structuredOutput 已校验的 response_format，nil 表示普通文本输出
+type structuredOutput struct {
+	Type   string
+	Name   string
+	Schema interface{}
+	raw    string
+}
+
+// parseResponseFormat 校验 response_format 参数
+func parseResponseFormat(rf *ResponseFormat) (*structuredOutput, error) {
+	if rf == nil || rf.Type == "" || rf.Type == ResponseFormatText {
+		return nil, nil
+	}
+
+	switch rf.Type {
+	case ResponseFormatJSONObject:
+		return &structuredOutput{Type: rf.Type}, nil
+	case ResponseFormatJSONSchema:
+		if rf.JSONSchema == nil || rf.JSONSchema.Name == "" {
+			return nil, fmt.Errorf("response_format.json_schema.name: required when type is json_schema")
+		}
+		out := &structuredOutput{Type: rf.Type, Name: rf.JSONSchema.Name}
+		if len(rf.JSONSchema.Schema) > 0 {
+			if err := json.Unmarshal(rf.JSONSchema.Schema, &out.Schema); err != nil {
+				return nil, fmt.Errorf("response_format.json_schema.schema: %v", err)
+			}
+			switch out.Schema.(type) {
+			case map[string]interface{}, bool:
+			default:
+				return nil, fmt.Errorf("response_format.json_schema.schema: must be an object")
+			}
+			if err := checkSchemaRefs(out.Schema); err != nil {
+				return nil, fmt.Errorf("response_format.json_schema.schema: %v", err)
+			}
+			out.raw = string(rf.JSONSchema.Schema)
+		}
+		if rf.JSONSchema.Description != "" {
+			out.Name += " (" + rf.JSONSchema.Description + ")"
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("response_format.type: must be one of text, json_object, json_schema, got %q", rf.Type)
+}
+
+// instructions 追加到 customPersonality 的输出格式要求
+func (s *structuredOutput) instructions() string {
+	var b strings.Builder
+	b.WriteString("Respond with a single valid JSON value only. Do not wrap it in markdown code fences and do not add any text before or after it.")
+	if s.Type == ResponseFormatJSONObject || s.Schema == nil {
+		b.WriteString(" The top-level value must be a JSON object.")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\nThe JSON must conform to the following JSON Schema named %s:\n%s", s.Name, s.raw)
+	return b.String()
+}
+
+// extract 去除 markdown 代码块，返回 JSON 文本
+func (s *structuredOutput) extract(content string) string {
+	text := strings.TrimSpace(content)
+	if json.Valid([]byte(text)) {
+		return text
+	}
+	if m := codeFencePattern.FindStringSubmatch(text); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return text
+}
+
+// validate 解析并校验模型输出，返回去除代码块后的 JSON
+func (s *structuredOutput) validate(content string) (string, error) {
+	text := s.extract(content)
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return text, fmt.Errorf("output is not valid JSON: %v", err)
+	}
+	if s.Type == ResponseFormatJSONObject || s.Schema == nil {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return text, fmt.Errorf("output is a JSON %s, expected an object", jsonTypeName(value))
+		}
+		return text, nil
+	}
+	if err := validateJSONSchema(s.Schema, value); err != nil {
+		return text, fmt.Errorf("output does not match schema: %v", err)
+	}
+	return text, nil
+}
+
+// correction 校验失败后重试使用的追加消息
+func (s *structuredOutput) correction(output string, err error) []Message {
+	return []Message{
+		{Role: "assistant", Content: output},
+		{Role: "user", Content: fmt.Sprintf("Your previous response was invalid: %v. Reply again with only the corrected JSON, without code fences or any other text.", err)},
+	}
+}
+
+// completeStructured 校验非流式输出，失败时带上错误说明重试一次上游
+func completeStructured(c completion, opts responseOptions, retry func([]Message) (*fhttp.Response, error)) (completion, error) {
+	output := c.Message.Content
+	text, err := opts.Structured.validate(output)
+	if err == nil {
+		c.Message.Content = text
+		return c, nil
+	}
+
+	LogInfo("Structured output failed validation, retrying once: %v", err)
+	resp, retryErr := retry(opts.Structured.correction(output, err))
+	if retryErr != nil {
+		return c, fmt.Errorf("model output did not match response_format (%v) and the retry request failed: %v", err, retryErr)
+	}
+	defer resp.Body.Close()
+
+	// 部分输出只展示第一次的结果
+	opts.Progress = nil
+	retried := collectCompletion(resp, opts)
+	if retried.UpstreamError {
+		return retried, nil
+	}
+	retried.Usage.PromptTokens += c.Usage.PromptTokens
+	retried.Usage.CompletionTokens += c.Usage.CompletionTokens
+	retried.Usage.TotalTokens += c.Usage.TotalTokens
+
+	if text, err = opts.Structured.validate(retried.Message.Content); err != nil {
+		return retried, fmt.Errorf("model output did not match response_format after one retry: %v", err)
+	}
+	retried.Message.Content = text
+	return retried, nil
+}
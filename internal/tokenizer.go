@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// EstimateTokens 估算文本的 token 数：CJK 字符按 1 个 token 计，其余字符约 4 字节 1 个 token
+func EstimateTokens(text string) int {
+	tokens, otherBytes := 0, 0
+	for _, r := range text {
+		if isCJK(r) {
+			tokens++
+			continue
+		}
+		otherBytes += utf8.RuneLen(r)
+	}
+	return tokens + (otherBytes+3)/4
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// truncateToTokens 截取不超过 budget 个 token 的最长前缀
+func truncateToTokens(text string, budget int) string {
+	if budget <= 0 {
+		return ""
+	}
+	tokens, otherBytes := 0, 0
+	for i, r := range text {
+		if isCJK(r) {
+			tokens++
+		} else {
+			otherBytes += utf8.RuneLen(r)
+		}
+		if tokens+(otherBytes+3)/4 > budget {
+			return text[:i]
+		}
+	}
+	return text
+}
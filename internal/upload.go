@@ -1,12 +1,17 @@
 package internal
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	fhttp "github.com/bogdanfinn/fhttp"
 )
@@ -21,63 +26,206 @@ type UploadResponse struct {
 	FileMetadataID string `json:"fileMetadataId"`
 }
 
-// 上传图片到 Grok 服务器，返回 fileMetadataId
-func UploadImage(imageURL, cookie string) (string, error) {
-	isURL := strings.HasPrefix(imageURL, "http://") || strings.HasPrefix(imageURL, "https://")
-	var imageBuffer, mimeType string
+// 支持上传的文件类型
+type fileType struct {
+	Kind string // 对应 upload_limits_mb 中的类别
+	Ext  string
+}
 
-	if isURL {
-		// 使用 TLS 客户端下载图片
-		client := GetHTTPClient()
-		req, err := fhttp.NewRequest("GET", imageURL, nil)
-		if err != nil {
-			return "", err
+var supportedFileTypes = map[string]fileType{
+	"image/jpeg":      {"image", "jpg"},
+	"image/png":       {"image", "png"},
+	"image/gif":       {"image", "gif"},
+	"image/webp":      {"image", "webp"},
+	"application/pdf": {"pdf", "pdf"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": {"document", "docx"},
+	"text/csv":      {"text", "csv"},
+	"text/plain":    {"text", "txt"},
+	"text/markdown": {"text", "md"},
+}
+
+// 上传失败策略
+const (
+	UploadPolicyDrop = "drop" // 丢弃上传失败的附件并继续请求
+	UploadPolicyFail = "fail" // 返回 400
+)
+
+// AttachmentError 附件本身不合法（类型不支持、过大、格式错误），应返回 400
+type AttachmentError struct {
+	Message string
+}
+
+func (e *AttachmentError) Error() string {
+	return e.Message
+}
+
+// 上传文件到 Grok 服务器，返回 fileMetadataId
+func UploadAttachment(att Attachment, token string) (string, error) {
+	if att.FileID != "" {
+		return resolveFileID(att.FileID, token)
+	}
+
+	data, declaredMime, err := loadAttachmentData(att)
+	if err != nil {
+		return "", err
+	}
+
+	mimeType, err := detectMimeType(data, declaredMime, att.Filename)
+	if err != nil {
+		return "", err
+	}
+	if att.Type == "image" && supportedFileTypes[mimeType].Kind != "image" {
+		return "", &AttachmentError{fmt.Sprintf("image_url content is %s, not an image", mimeType)}
+	}
+
+	ft := supportedFileTypes[mimeType]
+	imgCfg := GetConfig().ImageProcessing
+	process := ft.Kind == "image" && imgCfg.Enabled
+	// 开启预处理时图片在缩放后再检查 upload_limits_mb.image，原始内容只受 max_input_mb 限制
+	if process {
+		if limit := imageInputLimit(); limit > 0 && int64(len(data)) > limit {
+			return "", &AttachmentError{fmt.Sprintf("image file is %d bytes, exceeds input limit of %d MB", len(data), limit>>20)}
 		}
+	} else if err := checkUploadSize(mimeType, len(data)); err != nil {
+		return "", err
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return "", err
+	fileName := att.Filename
+	if fileName == "" {
+		base := "file"
+		if ft.Kind == "image" {
+			base = "image"
 		}
-		defer resp.Body.Close()
+		fileName = fmt.Sprintf("%s.%s", base, ft.Ext)
+	}
 
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
+	// 缓存键包含预处理参数，命中缓存时跳过预处理
+	maxDim := imgCfg.MaxDimension
+	if att.Detail == "low" {
+		maxDim = imgCfg.LowDetailDimension
+	}
+	key := uploadCacheKey(token, data)
+	if process {
+		key += fmt.Sprintf(":%d:%s:%d", maxDim, imgCfg.Format, imgCfg.JPEGQuality)
+	}
+
+	return uploads.getOrUpload(key, func() (string, error) {
+		if process {
+			processed, processedMime, err := preprocessImage(data, maxDim)
+			if err != nil {
+				return "", err
+			}
+			LogDebug("Preprocessed image %s: %d -> %d bytes, %s -> %s", fileName, len(data), len(processed), mimeType, processedMime)
+			if err := checkUploadSize(processedMime, len(processed)); err != nil {
+				return "", err
+			}
+			data, mimeType = processed, processedMime
+			fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + "." + supportedFileTypes[mimeType].Ext
+		}
+		return uploadFile(fileName, mimeType, data, BuildCookie(token))
+	})
+}
+
+// checkUploadSize 按文件类别检查大小上限
+func checkUploadSize(mimeType string, size int) error {
+	ft := supportedFileTypes[mimeType]
+	if limit := int64(GetConfig().UploadLimits[ft.Kind]) << 20; limit > 0 && int64(size) > limit {
+		return &AttachmentError{fmt.Sprintf("%s file is %d bytes, exceeds limit of %d MB", ft.Kind, size, limit>>20)}
+	}
+	return nil
+}
+
+// imageInputLimit 图片原始内容的大小上限（字节），开启预处理时为 image_processing.max_input_mb，否则为 upload_limits_mb.image
+func imageInputLimit() int64 {
+	cfg := GetConfig()
+	if cfg.ImageProcessing.Enabled {
+		return int64(cfg.ImageProcessing.MaxInputMB) << 20
+	}
+	return int64(cfg.UploadLimits["image"]) << 20
+}
+
+// loadAttachmentData 读取附件内容，返回原始字节和声明的 MIME 类型
+func loadAttachmentData(att Attachment) ([]byte, string, error) {
+	if strings.HasPrefix(att.Data, "http://") || strings.HasPrefix(att.Data, "https://") {
+		if att.Type != "image" {
+			return nil, "", &AttachmentError{"file_data must be base64 encoded, URLs are not supported"}
 		}
 
-		imageBuffer = base64.StdEncoding.EncodeToString(data)
-		mimeType = resp.Header.Get("Content-Type")
-		if mimeType == "" {
-			mimeType = "image/jpeg"
+		return fetchRemoteImage(att.Data)
+	}
+
+	// Base64 格式: data:image/jpeg;base64,xxx
+	encoded, declaredMime := att.Data, ""
+	if strings.HasPrefix(att.Data, "data:") {
+		parts := strings.SplitN(att.Data, ",", 2)
+		if len(parts) != 2 {
+			return nil, "", &AttachmentError{"malformed data URL"}
 		}
-	} else {
-		// Base64 格式: data:image/jpeg;base64,xxx
-		if strings.HasPrefix(imageURL, "data:") {
-			parts := strings.SplitN(imageURL, ",", 2)
-			if len(parts) == 2 {
-				imageBuffer = parts[1]
-				if strings.Contains(parts[0], ";") {
-					mimeType = strings.Split(parts[0], ";")[0][5:]
-				}
-			}
-		} else {
-			imageBuffer = imageURL
+		encoded = parts[1]
+		declaredMime = strings.Split(strings.TrimPrefix(parts[0], "data:"), ";")[0]
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", &AttachmentError{fmt.Sprintf("invalid base64 data: %v", err)}
+	}
+	return data, declaredMime, nil
+}
+
+// detectMimeType 通过内容嗅探确定文件类型，声明的类型和文件名仅用于区分同类文本和压缩格式
+func detectMimeType(data []byte, declaredMime, filename string) (string, error) {
+	sniffed := strings.Split(http.DetectContentType(data), ";")[0]
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	declaredMime = strings.ToLower(strings.TrimSpace(declaredMime))
+
+	switch {
+	case sniffed == "application/zip":
+		if isDocx(data) {
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document", nil
 		}
-		if mimeType == "" {
-			mimeType = "image/jpeg"
+	case sniffed == "text/plain":
+		switch {
+		case ext == "csv" || declaredMime == "text/csv":
+			return "text/csv", nil
+		case ext == "md" || ext == "markdown" || declaredMime == "text/markdown":
+			return "text/markdown", nil
 		}
+		return "text/plain", nil
+	default:
+		if _, ok := supportedFileTypes[sniffed]; ok {
+			return sniffed, nil
+		}
+	}
+
+	if isHEIC(data) {
+		return "", &AttachmentError{"HEIC/HEIF/AVIF images are not supported, please convert to JPEG or PNG"}
+	}
+
+	detected := sniffed
+	if declaredMime != "" {
+		detected = fmt.Sprintf("%s (declared %s)", sniffed, declaredMime)
 	}
+	return "", &AttachmentError{fmt.Sprintf("unsupported file type %s, supported types: images (jpeg, png, gif, webp), pdf, docx, csv, txt, md", detected)}
+}
 
-	ext := "jpg"
-	if strings.Contains(mimeType, "/") {
-		ext = strings.Split(mimeType, "/")[1]
+func isDocx(data []byte) bool {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return false
+	}
+	for _, f := range r.File {
+		if f.Name == "word/document.xml" {
+			return true
+		}
 	}
-	fileName := fmt.Sprintf("image.%s", ext)
+	return false
+}
 
+func uploadFile(fileName, mimeType string, data []byte, cookie string) (string, error) {
 	uploadReq := UploadRequest{
 		FileName:     fileName,
 		FileMimeType: mimeType,
-		Content:      imageBuffer,
+		Content:      base64.StdEncoding.EncodeToString(data),
 	}
 
 	body, err := json.Marshal(uploadReq)
@@ -102,8 +250,8 @@ func UploadImage(imageURL, cookie string) (string, error) {
 	if resp.StatusCode != 200 {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyText := string(bodyBytes)
-		LogError("Upload image failed - Status: %d, Response: %s", resp.StatusCode, bodyText)
-		return "", fmt.Errorf("upload image failed: status %d", resp.StatusCode)
+		LogError("Upload file failed - Status: %d, Response: %s", resp.StatusCode, bodyText)
+		return "", fmt.Errorf("upload file failed: status %d", resp.StatusCode)
 	}
 
 	var uploadResp UploadResponse
@@ -114,27 +262,41 @@ func UploadImage(imageURL, cookie string) (string, error) {
 	return uploadResp.FileMetadataID, nil
 }
 
-// 从消息中提取并上传所有图片
-func ExtractAndUploadImages(messages []Message, cookie string) ([]string, error) {
-	var imageURLs []string
-	for _, msg := range messages {
-		_, urls := msg.ParseContent()
-		imageURLs = append(imageURLs, urls...)
+// UploadAttachments 并发上传图片和文件，返回的文件 ID 与 attachments 一一对应，按 drop 策略丢弃的为空字符串；
+// 附件不合法或按策略上传失败时返回 AttachmentError
+func UploadAttachments(attachments []Attachment, token string) ([]string, error) {
+	if len(attachments) == 0 {
+		return nil, nil
 	}
 
-	if len(imageURLs) == 0 {
-		return nil, nil
+	cfg := GetConfig()
+	fileIDs := make([]string, len(attachments))
+	errs := make([]error, len(attachments))
+	sem := make(chan struct{}, cfg.UploadConcurrency)
+	var wg sync.WaitGroup
+
+	for i, att := range attachments {
+		wg.Add(1)
+		go func(i int, att Attachment) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			fileIDs[i], errs[i] = UploadAttachment(att, token)
+		}(i, att)
 	}
+	wg.Wait()
 
-	var fileIDs []string
-	for _, url := range imageURLs {
-		fileID, err := UploadImage(url, cookie)
+	for i, err := range errs {
 		if err != nil {
-			LogError("Failed to upload image: %v", err)
-			continue
-		}
-		if fileID != "" {
-			fileIDs = append(fileIDs, fileID)
+			var attErr *AttachmentError
+			if errors.As(err, &attErr) {
+				return nil, err
+			}
+			if cfg.UploadFailurePolicy == UploadPolicyFail {
+				return nil, &AttachmentError{fmt.Sprintf("failed to upload %s #%d: %v", attachments[i].Type, i+1, err)}
+			}
+			LogError("Failed to upload %s: %v", attachments[i].Type, err)
+			fileIDs[i] = ""
 		}
 	}
 
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// uploadCache 按（调用方, 内容 SHA-256）缓存上游 fileMetadataId，并合并同一内容的并发上传
+type uploadCache struct {
+	mu       sync.Mutex
+	entries  map[string]uploadCacheEntry
+	inflight map[string]*uploadCall
+}
+
+type uploadCacheEntry struct {
+	fileID    string
+	expiresAt time.Time
+}
+
+type uploadCall struct {
+	done   chan struct{}
+	fileID string
+	err    error
+}
+
+var uploads = &uploadCache{
+	entries:  make(map[string]uploadCacheEntry),
+	inflight: make(map[string]*uploadCall),
+}
+
+func uploadCacheKey(token string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return ownerID(token) + ":" + hex.EncodeToString(sum[:])
+}
+
+// getOrUpload 命中缓存直接返回，否则执行 upload；相同 key 的并发调用只上传一次
+func (c *uploadCache) getOrUpload(key string, upload func() (string, error)) (string, error) {
+	ttl := time.Duration(GetConfig().UploadCacheTTL) * time.Second
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expiresAt) {
+		c.mu.Unlock()
+		LogDebug("Upload cache hit: %s", key)
+		return e.fileID, nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.fileID, call.err
+	}
+	call := &uploadCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.fileID, call.err = upload()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil && ttl > 0 {
+		c.evictExpired()
+		c.entries[key] = uploadCacheEntry{fileID: call.fileID, expiresAt: time.Now().Add(ttl)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.fileID, call.err
+}
+
+// evictExpired 清理过期条目，调用方需持有锁
+func (c *uploadCache) evictExpired() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+}
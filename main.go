@@ -1,19 +1,58 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"os"
 
 	"grok-proxy/internal"
 )
 
 func main() {
-	internal.LoadConfig()
+	if err := internal.LoadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	internal.InitLogger()
+	if err := internal.InitFileStore(); err != nil {
+		internal.LogError("Failed to init file store: %v", err)
+		os.Exit(1)
+	}
+	if err := internal.InitBatchStore(); err != nil {
+		internal.LogError("Failed to init batch store: %v", err)
+		os.Exit(1)
+	}
+	internal.WatchConfig()
 
+	http.HandleFunc("/healthz", internal.HandleHealthz)
+	http.HandleFunc("/readyz", internal.HandleReadyz)
 	http.HandleFunc("/v1/models", internal.HandleModels)
-	http.HandleFunc("/v1/chat/completions", internal.HandleChatCompletions)
+	http.HandleFunc("/v1/models/{id}", internal.HandleModel)
+	http.HandleFunc("/v1/quota", internal.HandleQuota)
+	http.HandleFunc("/v1/chat/completions", internal.WithRateLimit(internal.HandleChatCompletions))
+	http.HandleFunc("/v1/completions", internal.WithRateLimit(internal.HandleCompletions))
+	http.HandleFunc("/v1/files", internal.HandleFiles)
+	http.HandleFunc("/v1/files/{id}", internal.HandleFile)
+	http.HandleFunc("/v1/files/{id}/content", internal.HandleFileContent)
+	http.HandleFunc("/v1/batches", internal.HandleBatches)
+	http.HandleFunc("/v1/batches/{id}", internal.HandleBatch)
+	http.HandleFunc("/v1/batches/{id}/cancel", internal.HandleBatchCancel)
+	http.HandleFunc("/v1/jobs", internal.WithRateLimit(internal.HandleJobs))
+	http.HandleFunc("/v1/jobs/{id}", internal.HandleJob)
+	http.HandleFunc("/v1/jobs/{id}/cancel", internal.HandleJobCancel)
+	http.HandleFunc("/api/chat", internal.WithRateLimit(internal.HandleOllamaChat))
+	http.HandleFunc("/api/generate", internal.WithRateLimit(internal.HandleOllamaGenerate))
+	http.HandleFunc("/api/tags", internal.HandleOllamaTags)
+	http.HandleFunc("/api/show", internal.HandleOllamaShow)
+	http.HandleFunc("/v1beta/models", internal.HandleGeminiModels)
+	http.HandleFunc("/v1beta/models/{action}", internal.WithRateLimit(internal.HandleGemini))
+
+	internal.StartUpstreamProbe()
+	internal.StartModelDiscovery()
+	internal.StartQuotaRefresh()
+	internal.ResumeBatches()
 
-	addr := ":" + internal.Cfg.Port
+	addr := ":" + internal.GetConfig().Port
 	internal.LogInfo("Server starting on %s", addr)
 	if err := http.ListenAndServe(addr, nil); err != nil {
 		internal.LogError("Server failed: %v", err)